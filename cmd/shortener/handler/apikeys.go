@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/GermanVor/shortener-pet-project/internal/apikeys"
+	"github.com/GermanVor/shortener-pet-project/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+type CreateAPIKeyRequest struct {
+	Name string `json:"name"`
+}
+
+type CreateAPIKeyResponse struct {
+	storage.APIKey
+
+	// Key is the bearer token, it is returned only once.
+	Key string `json:"key"`
+}
+
+func CreateAPIKeyEndpoint(ctx *gin.Context, stor storage.Interface) {
+	w := ctx.Writer
+	r := ctx.Request
+
+	userToken := ctx.GetString(SessionTokenName)
+	if userToken == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	request := &CreateAPIKeyRequest{}
+	if len(bodyBytes) != 0 {
+		if err = json.Unmarshal(bodyBytes, request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	keyID, token, err := apikeys.New()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	key := storage.APIKey{
+		ID:        keyID,
+		Name:      request.Name,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err = stor.CreateAPIKey(ctx.Request.Context(), userToken, key, apikeys.Hash(token)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	responseBytes, _ := json.Marshal(&CreateAPIKeyResponse{APIKey: key, Key: token})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(responseBytes)
+}
+
+func GetAPIKeysEndpoint(ctx *gin.Context, stor storage.Interface) {
+	w := ctx.Writer
+
+	userToken := ctx.GetString(SessionTokenName)
+	if userToken == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	keys, err := stor.GetAPIKeys(ctx.Request.Context(), userToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	responseBytes, _ := json.Marshal(keys)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseBytes)
+}
+
+func RevokeAPIKeyEndpoint(ctx *gin.Context, stor storage.Interface) {
+	w := ctx.Writer
+
+	userToken := ctx.GetString(SessionTokenName)
+	if userToken == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	err := stor.RevokeAPIKey(ctx.Request.Context(), userToken, ctx.Param("id"))
+	if errors.Is(err, storage.ErrValueNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
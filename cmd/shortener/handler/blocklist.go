@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/GermanVor/shortener-pet-project/internal/blocklist"
+	"github.com/gin-gonic/gin"
+)
+
+const AdminTokenHeader = "X-Admin-Token"
+
+// UseAdminMiddleware lets through only the requests having the admin token in
+// the AdminTokenHeader header.
+func UseAdminMiddleware(adminToken string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token := ctx.Request.Header.Get(AdminTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			ctx.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		ctx.Next()
+	}
+}
+
+func writeBlocklist(w http.ResponseWriter, blocked *blocklist.List) {
+	responseBytes, _ := json.Marshal(blocked.Entries())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseBytes)
+}
+
+func GetBlocklistEndpoint(ctx *gin.Context, blocked *blocklist.List) {
+	writeBlocklist(ctx.Writer, blocked)
+}
+
+// ChangeBlocklistEndpoint adds or removes the entries of the request depending
+// on its method, the resulting entries are responded.
+func ChangeBlocklistEndpoint(ctx *gin.Context, blocked *blocklist.List) {
+	w := ctx.Writer
+	r := ctx.Request
+
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	entries := []string{}
+	if err = json.Unmarshal(bodyBytes, &entries); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		err = blocked.Remove(entries...)
+	} else {
+		err = blocked.Add(entries...)
+	}
+
+	if errors.Is(err, blocklist.ErrBadEntry) {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeBlocklist(w, blocked)
+}
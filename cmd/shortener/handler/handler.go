@@ -2,23 +2,200 @@ package handler
 
 import (
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
-
+	"time"
+	"unicode/utf8"
+
+	"github.com/GermanVor/shortener-pet-project/internal/apikeys"
+	"github.com/GermanVor/shortener-pet-project/internal/blocklist"
+	"github.com/GermanVor/shortener-pet-project/internal/clicks"
+	"github.com/GermanVor/shortener-pet-project/internal/deletion"
+	"github.com/GermanVor/shortener-pet-project/internal/loopguard"
+	"github.com/GermanVor/shortener-pet-project/internal/preview"
+	"github.com/GermanVor/shortener-pet-project/internal/qr"
+	"github.com/GermanVor/shortener-pet-project/internal/session"
 	"github.com/GermanVor/shortener-pet-project/internal/storage"
+	"github.com/GermanVor/shortener-pet-project/internal/urlpolicy"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
 
 type UserUrls = storage.UserUrls
 
+// Options are the optional services used by the shortener handlers.
+type Options struct {
+	// Clicks records redirects, nil disables click tracking.
+	Clicks *clicks.Recorder
+	// Deletions deletes links in the background, with nil they are deleted
+	// while handling the request.
+	Deletions *deletion.Queue
+	// Blocklist rejects the blocked URLs, nil blocks nothing.
+	Blocklist *blocklist.List
+	// Loops recognizes the URLs of this and the other shorteners, nil
+	// shortens them as any other URL.
+	Loops *loopguard.Guard
+	// QRCodes caches the QR codes of the links, nil renders them every time.
+	QRCodes *qr.Cache
+	// BaseURL of the short links, the request host is used when empty.
+	BaseURL string
+	// Previews renders the link preview pages, nil always redirects.
+	Previews *preview.Renderer
+	// PreviewAll shows the preview page of every link.
+	PreviewAll bool
+	// AdminToken authorizes the admin API, it is disabled when empty.
+	AdminToken string
+}
+
 var SessionTokenName = "session_token"
 
-func MakeShortEndpoint(ctx *gin.Context, stor storage.Interface) {
+// userRoutesPrefix is the path prefix of the routes managing the links of the
+// user.
+const userRoutesPrefix = "/api/user/"
+
+// ReservedAliases can not be used as custom short URL ids because they clash
+// with the service routes.
+var ReservedAliases = map[string]bool{
+	"api":    true,
+	"ping":   true,
+	"admin":  true,
+	"debug":  true,
+	"static": true,
+}
+
+var aliasRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+var ErrBadAlias = errors.New("alias must be 1-64 latin letters, digits, '_' or '-'")
+var ErrReservedAlias = errors.New("alias is reserved")
+var ErrBadExpiry = errors.New("only one of expires_at and ttl can be set")
+var ErrBadTTL = errors.New("ttl must be positive")
+var ErrAlreadyExpired = errors.New("expires_at is in the past")
+
+// Maximal lengths of the link title and description in characters.
+const (
+	maxTitleLength       = 256
+	maxDescriptionLength = 2048
+)
+
+var ErrLongTitle = fmt.Errorf("title must be at most %d characters", maxTitleLength)
+var ErrLongDescription = fmt.Errorf("description must be at most %d characters", maxDescriptionLength)
+
+func ValidateAlias(alias string) error {
+	if alias == "" {
+		return nil
+	}
+
+	if !aliasRegexp.MatchString(alias) {
+		return ErrBadAlias
+	}
+
+	if ReservedAliases[strings.ToLower(alias)] {
+		return ErrReservedAlias
+	}
+
+	return nil
+}
+
+func ValidateShortenOptions(opts storage.ShortenOptions) error {
+	if err := ValidateAlias(opts.Alias); err != nil {
+		return err
+	}
+
+	if opts.ExpiresAt != nil && opts.TTL != 0 {
+		return ErrBadExpiry
+	}
+
+	if opts.TTL < 0 {
+		return ErrBadTTL
+	}
+
+	if opts.ExpiresAt != nil && !opts.ExpiresAt.After(time.Now()) {
+		return ErrAlreadyExpired
+	}
+
+	if utf8.RuneCountInString(opts.Title) > maxTitleLength {
+		return ErrLongTitle
+	}
+
+	if utf8.RuneCountInString(opts.Description) > maxDescriptionLength {
+		return ErrLongDescription
+	}
+
+	return nil
+}
+
+// CheckURL normalizes the URL and checks it is not blocked. The short links of
+// the shortener are replaced with their original URLs, so no redirect chains
+// are made.
+func CheckURL(ctx context.Context, stor storage.Interface, blocked *blocklist.List, loops *loopguard.Guard, rawURL string) (string, error) {
+	originalURL, err := urlpolicy.Normalize(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	if originalURL, err = resolveOwnURL(ctx, stor, loops, originalURL); err != nil {
+		return "", err
+	}
+
+	if blocked.Blocked(originalURL) {
+		return "", blocklist.ErrBlocked
+	}
+
+	return originalURL, nil
+}
+
+// resolveOwnURL follows the short links of the shortener to the URL they
+// redirect to.
+func resolveOwnURL(ctx context.Context, stor storage.Interface, loops *loopguard.Guard, originalURL string) (string, error) {
+	for hop := 0; hop <= loopguard.MaxHops; hop++ {
+		shortURLId, ok, err := loops.ShortURLId(originalURL)
+		if err != nil || !ok {
+			return originalURL, err
+		}
+
+		targetURL, err := stor.GetOriginalURL(ctx, shortURLId, "")
+		if errors.Is(err, storage.ErrValueNotFound) || errors.Is(err, storage.ErrValueGone) {
+			return "", loopguard.ErrOwnURL
+		} else if err != nil {
+			return "", err
+		}
+
+		originalURL = urlpolicy.Key(targetURL)
+	}
+
+	return "", loopguard.ErrRedirectLoop
+}
+
+// checkURLStatus is the response status of the CheckURL error.
+func checkURLStatus(err error) int {
+	switch {
+	case errors.Is(err, blocklist.ErrBlocked):
+		return http.StatusForbidden
+	case errors.Is(err, urlpolicy.ErrEmptyURL),
+		errors.Is(err, urlpolicy.ErrMalformedURL),
+		errors.Is(err, urlpolicy.ErrUnsupportedScheme),
+		errors.Is(err, urlpolicy.ErrMissingHost),
+		errors.Is(err, urlpolicy.ErrBadHost),
+		errors.Is(err, urlpolicy.ErrBadPort),
+		errors.Is(err, loopguard.ErrOwnURL),
+		errors.Is(err, loopguard.ErrShortenerURL),
+		errors.Is(err, loopguard.ErrRedirectLoop):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func MakeShortEndpoint(ctx *gin.Context, stor storage.Interface, blocked *blocklist.List, loops *loopguard.Guard) {
 	r := ctx.Request
 	w := ctx.Writer
 
@@ -42,10 +219,19 @@ func MakeShortEndpoint(ctx *gin.Context, stor storage.Interface) {
 		originalURL = string(bodyBytes)
 	}
 
-	shortURL, err := stor.ShortenURL(originalURL, ctx.GetString(SessionTokenName))
+	originalURL, err := CheckURL(r.Context(), stor, blocked, loops, originalURL)
+	if err != nil {
+		writeJSONError(w, checkURLStatus(err), err)
+		return
+	}
+
+	shortURL, err := stor.ShortenURL(ctx.Request.Context(), originalURL, ctx.GetString(SessionTokenName), storage.ShortenOptions{})
 
 	if err == storage.ErrValueAlreadyShorted {
 		w.WriteHeader(http.StatusConflict)
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	} else {
 		w.WriteHeader(http.StatusCreated)
 	}
@@ -54,17 +240,39 @@ func MakeShortEndpoint(ctx *gin.Context, stor storage.Interface) {
 	w.Write([]byte(shortURL))
 }
 
-func GetFullStrEndpoint(ctx *gin.Context, stor storage.Interface) {
+// GetFullStrEndpoint redirects to the original URL, the links to the URLs
+// blocked after they were shortened are unavailable for legal reasons.
+//
+// The preview page showing where the link leads is rendered instead when the
+// id ends with '+', the preview query parameter is set, the link was created
+// with preview or previewAll is set.
+func GetFullStrEndpoint(ctx *gin.Context, stor storage.Interface, recorder *clicks.Recorder, blocked *blocklist.List, pages *preview.Renderer, previewAll bool) {
 	w := ctx.Writer
 
 	shortURL := ctx.Param("id")
 
+	showPreview := previewAll
+	if strings.HasSuffix(shortURL, "+") {
+		shortURL = strings.TrimSuffix(shortURL, "+")
+		showPreview = true
+	}
+
+	if previewStr, ok := ctx.GetQuery("preview"); ok {
+		previewRequested, err := strconv.ParseBool(previewStr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		showPreview = showPreview || previewRequested
+	}
+
 	if shortURL == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	originalURL, err := stor.GetOriginalURL(shortURL, ctx.GetString(SessionTokenName))
+	info, err := stor.GetLinkInfo(ctx.Request.Context(), shortURL, ctx.GetString(SessionTokenName))
 
 	if err != nil {
 		if errors.Is(err, storage.ErrValueNotFound) {
@@ -74,20 +282,55 @@ func GetFullStrEndpoint(ctx *gin.Context, stor storage.Interface) {
 		} else {
 			w.WriteHeader(http.StatusInternalServerError)
 		}
+	} else if blocked.Blocked(info.OriginalURL) {
+		w.WriteHeader(http.StatusUnavailableForLegalReasons)
+	} else if pages != nil && (showPreview || info.Preview) {
+		page := preview.NewPage(info.ShortURL, info.OriginalURL, info.Title, info.Description, info.CreatedAt)
+		pageBytes, err := pages.Render(page)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// The click is not recorded, the visitor may not leave for the
+		// original URL.
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		w.Write(pageBytes)
 	} else {
-		w.Header().Set("Location", originalURL)
-		w.WriteHeader(http.StatusTemporaryRedirect)
+		redirect(ctx, recorder, shortURL, info.OriginalURL)
 	}
 }
 
+func redirect(ctx *gin.Context, recorder *clicks.Recorder, shortURL, originalURL string) {
+	ctx.Writer.Header().Set("Location", originalURL)
+	ctx.Writer.WriteHeader(http.StatusTemporaryRedirect)
+
+	recorder.Record(shortURL, ctx.Request.Referer(), ctx.Request.UserAgent(), ctx.ClientIP())
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	responseBytes, _ := json.Marshal(&ErrorResponse{Error: err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(responseBytes)
+}
+
 type MakeShortPostEndpointRequest struct {
 	URL string `json:"url"`
+
+	storage.ShortenOptions
 }
 type MakeShortPostEndpointResponse struct {
 	Result string `json:"result"`
 }
 
-func MakeShortPostEndpoint(ctx *gin.Context, stor storage.Interface) {
+func MakeShortPostEndpoint(ctx *gin.Context, stor storage.Interface, blocked *blocklist.List, loops *loopguard.Guard) {
 	w := ctx.Writer
 	r := ctx.Request
 
@@ -104,7 +347,18 @@ func MakeShortPostEndpoint(ctx *gin.Context, stor storage.Interface) {
 		return
 	}
 
-	shortURL, err := stor.ShortenURL(request.URL, ctx.GetString(SessionTokenName))
+	if request.URL, err = CheckURL(r.Context(), stor, blocked, loops, request.URL); err != nil {
+		writeJSONError(w, checkURLStatus(err), err)
+		return
+	}
+
+	err = ValidateShortenOptions(request.ShortenOptions)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	shortURL, err := stor.ShortenURL(ctx.Request.Context(), request.URL, ctx.GetString(SessionTokenName), request.ShortenOptions)
 
 	respose := &MakeShortPostEndpointResponse{
 		Result: shortURL,
@@ -113,6 +367,12 @@ func MakeShortPostEndpoint(ctx *gin.Context, stor storage.Interface) {
 
 	if err == storage.ErrValueAlreadyShorted {
 		w.WriteHeader(http.StatusConflict)
+	} else if err == storage.ErrAliasTaken {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	} else {
 		w.WriteHeader(http.StatusCreated)
 	}
@@ -122,15 +382,106 @@ func MakeShortPostEndpoint(ctx *gin.Context, stor storage.Interface) {
 }
 
 type MakeShortsPostEndpointRequest = storage.MappingItem
+
+// Statuses of the batch items.
+const (
+	BatchStatusCreated  = "created"
+	BatchStatusExisting = "existing"
+	BatchStatusInvalid  = "invalid"
+	BatchStatusError    = "error"
+)
+
 type MakeShortsPostEndpointResponse struct {
 	CorrelationID string `json:"correlation_id"`
-	ShortURL      string `json:"short_url"`
+	ShortURL      string `json:"short_url,omitempty"`
+	Status        string `json:"status"`
+	Message       string `json:"message,omitempty"`
+	// QR is the data URI of the short URL QR code, it is set on request.
+	QR string `json:"qr,omitempty"`
 }
 
-func MakeShortsPostEndpoint(ctx *gin.Context, stor storage.Interface) {
+// shortenItems shortens the items with the response of every item put to resp
+// at the same index. The items with a status already set are skipped, the
+// blocked ones get the invalid status.
+func shortenItems(ctx *gin.Context, stor storage.Interface, blocked *blocklist.List, loops *loopguard.Guard, req []MakeShortsPostEndpointRequest, resp []MakeShortsPostEndpointResponse) error {
+	// valid holds the indices of the items passed to the storage.
+	valid := make([]int, 0, len(req))
+	items := make([]storage.MappingItem, 0, len(req))
+
+	for i, item := range req {
+		if resp[i].Status != "" {
+			continue
+		}
+
+		resp[i].CorrelationID = item.CorrelationID
+
+		originalURL, err := CheckURL(ctx.Request.Context(), stor, blocked, loops, item.OriginalURL)
+		if err != nil && checkURLStatus(err) == http.StatusInternalServerError {
+			resp[i].Status = BatchStatusError
+			resp[i].Message = err.Error()
+			continue
+		}
+
+		if err == nil {
+			err = ValidateShortenOptions(item.ShortenOptions)
+		}
+
+		if err != nil {
+			resp[i].Status = BatchStatusInvalid
+			resp[i].Message = err.Error()
+			continue
+		}
+
+		item.OriginalURL = originalURL
+
+		valid = append(valid, i)
+		items = append(items, item)
+	}
+
+	next := 0
+	return stor.ForEach(ctx.Request.Context(), items, ctx.GetString(SessionTokenName), func(correlationID, shortURL string, err error) error {
+		item := &resp[valid[next]]
+		next++
+
+		item.ShortURL = shortURL
+
+		switch {
+		case err == nil:
+			item.Status = BatchStatusCreated
+		case errors.Is(err, storage.ErrValueAlreadyShorted):
+			item.Status = BatchStatusExisting
+		default:
+			item.Status = BatchStatusError
+			item.Message = err.Error()
+		}
+
+		return nil
+	})
+}
+
+// MakeShortsPostEndpoint responds with the result of every item in the request
+// order. The status is 201 when all the items are created and 207 otherwise.
+// The include_qr query parameter adds the QR codes of the short URLs made
+// with the QRCodeEndpoint parameters.
+func MakeShortsPostEndpoint(ctx *gin.Context, stor storage.Interface, blocked *blocklist.List, loops *loopguard.Guard, codes *qr.Cache) {
 	w := ctx.Writer
 	r := ctx.Request
 
+	includeQR := false
+	if includeQRStr, ok := ctx.GetQuery("include_qr"); ok {
+		var err error
+		if includeQR, err = strconv.ParseBool(includeQRStr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	qrOpts, err := parseQROptions(ctx)
+	if includeQR && err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -144,25 +495,47 @@ func MakeShortsPostEndpoint(ctx *gin.Context, stor storage.Interface) {
 		return
 	}
 
-	resp := make([]MakeShortsPostEndpointResponse, 0)
+	resp := make([]MakeShortsPostEndpointResponse, len(req))
+	if err = shortenItems(ctx, stor, blocked, loops, req, resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	stor.ForEach(req, ctx.GetString(SessionTokenName), func(correlationID, shortURL string) error {
-		resp = append(resp, MakeShortsPostEndpointResponse{
-			CorrelationID: correlationID,
-			ShortURL:      shortURL,
-		})
+	if includeQR {
+		addQRCodes(codes, qrOpts, resp)
+	}
 
-		return nil
-	})
+	status := http.StatusCreated
+	for _, item := range resp {
+		if item.Status != BatchStatusCreated {
+			status = http.StatusMultiStatus
+			break
+		}
+	}
 
 	responseBytes, _ := json.Marshal(resp)
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(status)
 	w.Write(responseBytes)
 }
 
-func DeleteUrls(ctx *gin.Context, stor storage.Interface) {
+// MetricsResponse holds the metrics of the background services.
+type MetricsResponse struct {
+	DeletionQueue deletion.Metrics `json:"deletion_queue"`
+}
+
+func GetMetricsEndpoint(ctx *gin.Context, queue *deletion.Queue) {
+	w := ctx.Writer
+
+	responseBytes, _ := json.Marshal(MetricsResponse{DeletionQueue: queue.Metrics()})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseBytes)
+}
+
+func DeleteUrls(ctx *gin.Context, stor storage.Interface, queue *deletion.Queue) {
 	w := ctx.Writer
 	r := ctx.Request
 
@@ -179,78 +552,390 @@ func DeleteUrls(ctx *gin.Context, stor storage.Interface) {
 		return
 	}
 
-	err = stor.DeleteKeys(keys, ctx.GetString(SessionTokenName))
+	if queue != nil {
+		err = queue.Enqueue(ctx.Request.Context(), ctx.GetString(SessionTokenName), keys)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	} else {
+		err = stor.DeleteKeys(ctx.Request.Context(), keys, ctx.GetString(SessionTokenName))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// RestoreUrlsEndpoint brings back the deleted links which are not purged yet
+// and responds with the restored ids. The deletions still waiting in the queue
+// are canceled, so they do not delete the links again.
+func RestoreUrlsEndpoint(ctx *gin.Context, stor storage.Interface, queue *deletion.Queue) {
+	w := ctx.Writer
+	r := ctx.Request
+
+	userToken := ctx.GetString(SessionTokenName)
+	if userToken == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusAccepted)
+	keys := []string{}
+	err = json.Unmarshal(bodyBytes, &keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	canceled := []string{}
+	if queue != nil {
+		canceled = queue.Cancel(userToken, keys)
+	}
+
+	restored, err := stor.RestoreKeys(ctx.Request.Context(), keys, userToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The links of the canceled deletions are kept, so they are restored too.
+	for _, key := range canceled {
+		if !slices.Contains(restored, key) {
+			restored = append(restored, key)
+		}
+	}
+
+	responseBytes, _ := json.Marshal(restored)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseBytes)
+}
+
+// Page sizes of GetUsersArchiveEndpoint.
+const (
+	defaultArchiveLimit = 100
+	maxArchiveLimit     = 1000
+)
+
+var ErrBadArchiveLimit = fmt.Errorf("limit must be from 1 to %d", maxArchiveLimit)
+var ErrBadArchiveOrder = errors.New("order must be asc or desc")
+
+// parseArchiveOptions reads the query parameters of GetUsersArchiveEndpoint.
+// The archive is paginated once limit or cursor is passed.
+func parseArchiveOptions(ctx *gin.Context) (opts storage.ArchiveOptions, paginated bool, err error) {
+	if includeDeleted := ctx.Query("include_deleted"); includeDeleted != "" {
+		if opts.IncludeDeleted, err = strconv.ParseBool(includeDeleted); err != nil {
+			return opts, false, errors.New("include_deleted must be a boolean")
+		}
+	}
+
+	if opts.Sort, err = storage.ParseArchiveSort(ctx.Query("sort")); err != nil {
+		return opts, false, err
+	}
+
+	switch ctx.Query("order") {
+	case "", "desc":
+	case "asc":
+		opts.Ascending = true
+	default:
+		return opts, false, ErrBadArchiveOrder
+	}
+
+	opts.Query = ctx.Query("q")
+	opts.Domain = strings.TrimSpace(ctx.Query("domain"))
+	opts.Tag = NormalizeTag(ctx.Query("tag"))
+	opts.Cursor = ctx.Query("cursor")
+
+	if opts.Folder, err = NormalizeFolder(ctx.Query("folder")); err != nil {
+		return opts, false, err
+	}
+
+	limit, hasLimit := ctx.GetQuery("limit")
+	if hasLimit {
+		if opts.Limit, err = strconv.Atoi(limit); err != nil || opts.Limit < 1 || opts.Limit > maxArchiveLimit {
+			return opts, false, ErrBadArchiveLimit
+		}
+	} else if opts.Cursor != "" {
+		opts.Limit = defaultArchiveLimit
+	}
+
+	return opts, opts.Limit > 0, nil
 }
 
+// GetUsersArchiveEndpoint responds with the JSON array of the user links, or
+// with a page of them having the next_cursor when the archive is paginated.
 func GetUsersArchiveEndpoint(ctx *gin.Context, stor storage.Interface) {
 	w := ctx.Writer
 
+	opts, paginated, err := parseArchiveOptions(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	userToken := ctx.GetString(SessionTokenName)
-	archive, err := stor.GetUserArchive(userToken)
+	page, err := stor.GetUserArchive(ctx.Request.Context(), userToken, opts)
+
+	if errors.Is(err, storage.ErrInvalidCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	if err != nil {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	responseBytes, _ := json.Marshal(archive)
+	var responseBytes []byte
+	if paginated {
+		responseBytes, _ = json.Marshal(page)
+	} else {
+		responseBytes, _ = json.Marshal(page.URLs)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write(responseBytes)
 }
 
-func UseCookieMiddlware(ctx *gin.Context) {
-	cookie, err := ctx.Request.Cookie(SessionTokenName)
+func GetLinkStatsEndpoint(ctx *gin.Context, stor storage.Interface) {
+	w := ctx.Writer
+
+	userToken := ctx.GetString(SessionTokenName)
+	if userToken == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	stats, err := stor.GetLinkStats(ctx.Request.Context(), ctx.Param("id"), userToken)
 	if err != nil {
-		log.Println(err)
+		if errors.Is(err, storage.ErrValueNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		return
 	}
 
-	if cookie == nil && ctx.Request.Method == http.MethodPost {
-		cookie = &http.Cookie{
-			Name:  SessionTokenName,
-			Value: uuid.NewString(),
+	responseBytes, _ := json.Marshal(stats)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseBytes)
+}
+
+// untimedRoutes are not bounded by the request timeout because they may last
+// as long as the client keeps sending data.
+var untimedRoutes = map[string]bool{
+	"/api/shorten/stream": true,
+}
+
+// UseTimeoutMiddleware bounds the request context, so the storage calls of a
+// slow request are cancelled. A non-positive timeout disables it.
+func UseTimeoutMiddleware(timeout time.Duration) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if timeout <= 0 || untimedRoutes[ctx.FullPath()] {
+			ctx.Next()
+			return
 		}
 
-		http.SetCookie(ctx.Writer, cookie)
+		requestCtx, cancel := context.WithTimeout(ctx.Request.Context(), timeout)
+		defer cancel()
+
+		ctx.Request = ctx.Request.WithContext(requestCtx)
+		ctx.Next()
 	}
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
 
-	if cookie != nil {
-		ctx.Set(SessionTokenName, cookie.Value)
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return "", false
 	}
 
-	ctx.Next()
+	return strings.TrimSpace(authorization[len(prefix):]), true
+}
+
+func setSessionCookie(ctx *gin.Context, codec *session.Codec, userUUID string) error {
+	token, err := codec.Encode(userUUID)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(ctx.Writer, &http.Cookie{
+		Name:     SessionTokenName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
 }
 
-func InitShortenerHandlers(router *gin.Engine, stor storage.Interface) *gin.Engine {
+// UseCookieMiddlware puts the user ID into the context. Programmatic clients
+// are authenticated with an `Authorization: Bearer` API key, the others with
+// the signed session cookie. A new user gets a cookie on the first POST
+// request. A cookie failed to decode is replaced with a new session, only the
+// user routes reject it with 401 as it may belong to the links owner. An
+// unknown API key is rejected with 401.
+func UseCookieMiddlware(codec *session.Codec, stor storage.Interface) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		userUUID := ""
+
+		if token, ok := bearerToken(ctx.Request); ok {
+			if !apikeys.IsToken(token) {
+				ctx.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+
+			userUUID, err := stor.GetAPIKeyUser(ctx.Request.Context(), apikeys.Hash(token))
+			if errors.Is(err, storage.ErrValueNotFound) {
+				ctx.AbortWithStatus(http.StatusUnauthorized)
+				return
+			} else if err != nil {
+				http.Error(ctx.Writer, err.Error(), http.StatusInternalServerError)
+				ctx.Abort()
+				return
+			}
+
+			ctx.Set(SessionTokenName, userUUID)
+			ctx.Next()
+			return
+		}
+
+		cookie, err := ctx.Request.Cookie(SessionTokenName)
+		if err == nil {
+			var stale bool
+			userUUID, stale, err = codec.Decode(cookie.Value)
+			if err != nil {
+				if strings.HasPrefix(ctx.Request.URL.Path, userRoutesPrefix) {
+					ctx.AbortWithStatus(http.StatusUnauthorized)
+					return
+				}
+
+				userUUID = uuid.NewString()
+				err = setSessionCookie(ctx, codec, userUUID)
+			} else if stale {
+				err = setSessionCookie(ctx, codec, userUUID)
+			}
+		} else if ctx.Request.Method == http.MethodPost {
+			userUUID = uuid.NewString()
+			err = setSessionCookie(ctx, codec, userUUID)
+		} else {
+			err = nil
+		}
+
+		if err != nil {
+			log.Println("Session cookie could not be set", err)
+		}
+
+		if userUUID != "" {
+			ctx.Set(SessionTokenName, userUUID)
+		}
+
+		ctx.Next()
+	}
+}
+
+func InitShortenerHandlers(router *gin.Engine, stor storage.Interface, opts Options) *gin.Engine {
 	router.POST("/", func(ctx *gin.Context) {
-		MakeShortEndpoint(ctx, stor)
+		MakeShortEndpoint(ctx, stor, opts.Blocklist, opts.Loops)
 	})
 
 	router.POST("/api/shorten", func(ctx *gin.Context) {
-		MakeShortPostEndpoint(ctx, stor)
+		MakeShortPostEndpoint(ctx, stor, opts.Blocklist, opts.Loops)
 	})
 
 	router.POST("/api/shorten/batch", func(ctx *gin.Context) {
-		MakeShortsPostEndpoint(ctx, stor)
+		MakeShortsPostEndpoint(ctx, stor, opts.Blocklist, opts.Loops, opts.QRCodes)
+	})
+
+	router.POST("/api/shorten/stream", func(ctx *gin.Context) {
+		MakeShortsStreamEndpoint(ctx, stor, opts.Blocklist, opts.Loops)
 	})
 
 	router.GET("/:id", func(ctx *gin.Context) {
-		GetFullStrEndpoint(ctx, stor)
+		GetFullStrEndpoint(ctx, stor, opts.Clicks, opts.Blocklist, opts.Previews, opts.PreviewAll)
+	})
+
+	router.GET("/:id/qr", func(ctx *gin.Context) {
+		QRCodeEndpoint(ctx, stor, opts.QRCodes, opts.BaseURL)
 	})
 
 	router.GET("/api/user/urls", func(ctx *gin.Context) {
 		GetUsersArchiveEndpoint(ctx, stor)
 	})
 
+	router.GET("/api/user/urls/:id/stats", func(ctx *gin.Context) {
+		GetLinkStatsEndpoint(ctx, stor)
+	})
+
 	router.DELETE("/api/user/urls", func(ctx *gin.Context) {
-		DeleteUrls(ctx, stor)
+		DeleteUrls(ctx, stor, opts.Deletions)
+	})
+
+	router.POST("/api/user/urls/restore", func(ctx *gin.Context) {
+		RestoreUrlsEndpoint(ctx, stor, opts.Deletions)
+	})
+
+	router.POST("/api/user/urls/:id/tags", func(ctx *gin.Context) {
+		ChangeTagsEndpoint(ctx, stor)
+	})
+
+	router.DELETE("/api/user/urls/:id/tags", func(ctx *gin.Context) {
+		ChangeTagsEndpoint(ctx, stor)
+	})
+
+	router.PUT("/api/user/urls/:id/folder", func(ctx *gin.Context) {
+		MoveToFolderEndpoint(ctx, stor)
+	})
+
+	router.POST("/api/user/keys", func(ctx *gin.Context) {
+		CreateAPIKeyEndpoint(ctx, stor)
+	})
+
+	router.GET("/api/user/keys", func(ctx *gin.Context) {
+		GetAPIKeysEndpoint(ctx, stor)
+	})
+
+	router.DELETE("/api/user/keys/:id", func(ctx *gin.Context) {
+		RevokeAPIKeyEndpoint(ctx, stor)
 	})
 
+	if opts.AdminToken != "" {
+		admin := router.Group("/api/admin", UseAdminMiddleware(opts.AdminToken))
+
+		if opts.Blocklist != nil {
+			admin.GET("/blocklist", func(ctx *gin.Context) {
+				GetBlocklistEndpoint(ctx, opts.Blocklist)
+			})
+
+			admin.POST("/blocklist", func(ctx *gin.Context) {
+				ChangeBlocklistEndpoint(ctx, opts.Blocklist)
+			})
+
+			admin.DELETE("/blocklist", func(ctx *gin.Context) {
+				ChangeBlocklistEndpoint(ctx, opts.Blocklist)
+			})
+		}
+
+		if opts.Deletions != nil {
+			admin.GET("/metrics", func(ctx *gin.Context) {
+				GetMetricsEndpoint(ctx, opts.Deletions)
+			})
+		}
+	}
+
 	return router
 }
@@ -5,13 +5,25 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/GermanVor/shortener-pet-project/cmd/shortener/handler"
+	"github.com/GermanVor/shortener-pet-project/internal/blocklist"
+	"github.com/GermanVor/shortener-pet-project/internal/clicks"
+	"github.com/GermanVor/shortener-pet-project/internal/deletion"
+	"github.com/GermanVor/shortener-pet-project/internal/idgen"
+	"github.com/GermanVor/shortener-pet-project/internal/loopguard"
+	"github.com/GermanVor/shortener-pet-project/internal/preview"
+	"github.com/GermanVor/shortener-pet-project/internal/qr"
+	"github.com/GermanVor/shortener-pet-project/internal/session"
 	"github.com/GermanVor/shortener-pet-project/internal/storage"
 	"github.com/bmizerany/assert"
 	"github.com/gin-gonic/gin"
@@ -20,10 +32,33 @@ import (
 )
 
 var (
+	ctx = context.Background()
+
 	endpointURL = "http://127.0.0.1:8080"
 	connString  = "postgres://zzman:@localhost:5432/test"
+
+	idGen, _ = idgen.NewRandom(8, idgen.Base62Alphabet)
+
+	sessionCodec, _ = session.NewCodec([]string{"test-session-key-0123456789"}, false)
 )
 
+func SessionCookie(t *testing.T, userUUID string) *http.Cookie {
+	token, err := sessionCodec.Encode(userUUID)
+	require.NoError(t, err)
+
+	return &http.Cookie{
+		Name:  handler.SessionTokenName,
+		Value: token,
+	}
+}
+
+func initV1(t *testing.T) *storage.V1 {
+	stor, err := storage.InitV1(endpointURL, "", idGen, storage.DedupeGlobal)
+	require.NoError(t, err)
+
+	return stor
+}
+
 func CleanDB() {
 	conn, err := pgxpool.Connect(context.TODO(), connString)
 	if err != nil {
@@ -63,9 +98,9 @@ func TestShortenURLV1(t *testing.T) {
 
 	testBody := func(tt *testing.T, stor storage.Interface) {
 		router := gin.Default()
-		handler.InitShortenerHandlers(router, stor)
+		handler.InitShortenerHandlers(router, stor, handler.Options{})
 
-		originalURL := "qwe"
+		originalURL := "http://oknetcumk.biz/qwe"
 		shortURL := ""
 
 		{
@@ -117,7 +152,7 @@ func TestShortenURLV1(t *testing.T) {
 	}
 
 	t.Run("Storage mock", func(tt *testing.T) {
-		stor := storage.InitV1(endpointURL, "")
+		stor := initV1(t)
 
 		testBody(tt, stor)
 	})
@@ -127,7 +162,7 @@ func TestShortenURLV1(t *testing.T) {
 	// 	defer CleanDB()
 
 	// 	dbContext := context.Background()
-	// 	stor, err := storage.InitV2(endpointURL, dbContext, connString)
+	// 	stor, err := storage.InitV2(endpointURL, dbContext, connString, idGen, storage.DedupeGlobal)
 	// 	require.NoError(tt, err)
 
 	// 	testBody(tt, stor)
@@ -138,8 +173,8 @@ func TestShortenURLV2(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	router := gin.Default()
-	storage := storage.InitV1(endpointURL, "")
-	handler.InitShortenerHandlers(router, storage)
+	storage := initV1(t)
+	handler.InitShortenerHandlers(router, storage, handler.Options{})
 
 	originalURL := "http://oknetcumk.biz/" + t.Name()
 	shortURL := ""
@@ -176,8 +211,8 @@ func TestMiddlwareV1(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	router := gin.Default()
-	storage := storage.InitV1(endpointURL, "")
-	handler.InitShortenerHandlers(router, storage)
+	storage := initV1(t)
+	handler.InitShortenerHandlers(router, storage, handler.Options{})
 
 	originalURL := "http://oknetcumk.biz/" + t.Name()
 	shortURL := ""
@@ -214,8 +249,8 @@ func TestMiddlwareV2(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	router := gin.Default()
-	storage := storage.InitV1(endpointURL, "")
-	handler.InitShortenerHandlers(router, storage)
+	storage := initV1(t)
+	handler.InitShortenerHandlers(router, storage, handler.Options{})
 
 	originalURL := "http://oknetcumk.biz/" + t.Name()
 	shortURL := ""
@@ -251,20 +286,17 @@ func TestMiddlwareV2(t *testing.T) {
 func TestMiddlware(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
-	storage := storage.InitV1(endpointURL, "")
+	storage := initV1(t)
 
 	router := gin.Default()
-	router.Use(handler.UseCookieMiddlware)
+	router.Use(handler.UseCookieMiddlware(sessionCodec, storage))
 
-	handler.InitShortenerHandlers(router, storage)
+	handler.InitShortenerHandlers(router, storage, handler.Options{})
 
 	originalURL := "http://oknetcumk.biz/1"
 	shortURL := ""
 
-	cookie := &http.Cookie{
-		Name:  handler.SessionTokenName,
-		Value: "some_token",
-	}
+	cookie := SessionCookie(t, "some_token")
 
 	{
 		bodyReader := bytes.NewReader([]byte(originalURL))
@@ -310,13 +342,14 @@ func TestMiddlware(t *testing.T) {
 func TestMakeShortsPostEndpoint(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
-	storage := storage.InitV1(endpointURL, "")
+	stor := initV1(t)
 
 	router := gin.Default()
-	router.Use(handler.UseCookieMiddlware)
+	router.Use(handler.UseCookieMiddlware(sessionCodec, stor))
 
-	handler.InitShortenerHandlers(router, storage)
+	handler.InitShortenerHandlers(router, stor, handler.Options{})
 
+	firstShortURL := ""
 	requestBody := []handler.MakeShortsPostEndpointRequest{
 		{CorrelationID: "qwe", OriginalURL: "http://oknetcumk.biz/1"},
 	}
@@ -344,7 +377,43 @@ func TestMakeShortsPostEndpoint(t *testing.T) {
 
 		assert.Equal(t, requestBody[0].CorrelationID, responseBody[0].CorrelationID)
 
+		assert.Equal(t, handler.BatchStatusCreated, responseBody[0].Status)
+
 		CheckRedirect(t, responseBody[0].ShortURL, requestBody[0].OriginalURL, router.ServeHTTP)
+		firstShortURL = responseBody[0].ShortURL
+	}
+
+	{
+		mixedBody := []handler.MakeShortsPostEndpointRequest{
+			{CorrelationID: "existing", OriginalURL: "http://oknetcumk.biz/1"},
+			{CorrelationID: "created", OriginalURL: "http://oknetcumk.biz/2"},
+			{CorrelationID: "invalid", OriginalURL: "http://oknetcumk.biz/3", ShortenOptions: storage.ShortenOptions{TTL: -1}},
+			{CorrelationID: "error", OriginalURL: "http://oknetcumk.biz/4", ShortenOptions: storage.ShortenOptions{Alias: "taken"}},
+		}
+
+		_, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/5", "", storage.ShortenOptions{Alias: "taken"})
+		require.NoError(t, err)
+
+		requestBytes, _ := json.Marshal(mixedBody)
+		req, err := http.NewRequest(http.MethodPost, endpointURL+"/api/shorten/batch", bytes.NewReader(requestBytes))
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		require.Equal(t, http.StatusMultiStatus, recorder.Code)
+
+		responseBody := []handler.MakeShortsPostEndpointResponse{}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &responseBody))
+		require.Equal(t, len(mixedBody), len(responseBody))
+
+		statuses := []string{handler.BatchStatusExisting, handler.BatchStatusCreated, handler.BatchStatusInvalid, handler.BatchStatusError}
+		for i, item := range responseBody {
+			assert.Equal(t, mixedBody[i].CorrelationID, item.CorrelationID)
+			assert.Equal(t, statuses[i], item.Status)
+		}
+
+		assert.Equal(t, firstShortURL, responseBody[0].ShortURL)
+		assert.Equal(t, "", responseBody[3].ShortURL)
 	}
 }
 
@@ -353,17 +422,14 @@ func TestDeleteEndpoint(t *testing.T) {
 
 	testBody := func(tt *testing.T, stor storage.Interface) {
 		router := gin.Default()
-		router.Use(handler.UseCookieMiddlware)
+		router.Use(handler.UseCookieMiddlware(sessionCodec, stor))
 
-		handler.InitShortenerHandlers(router, stor)
+		handler.InitShortenerHandlers(router, stor, handler.Options{})
 
-		originalURLs := []string{"qwe", "rty"}
+		originalURLs := []string{"http://oknetcumk.biz/qwe", "http://oknetcumk.biz/rty"}
 		shortURLsID := make([]string, len(originalURLs))
 
-		cookie := &http.Cookie{
-			Name:  handler.SessionTokenName,
-			Value: "some_token",
-		}
+		cookie := SessionCookie(t, "some_token")
 
 		for i, originalURL := range originalURLs {
 			bodyReader := bytes.NewReader([]byte(originalURL))
@@ -418,7 +484,7 @@ func TestDeleteEndpoint(t *testing.T) {
 	}
 
 	t.Run("Storage mock", func(tt *testing.T) {
-		stor := storage.InitV1(endpointURL, "")
+		stor := initV1(t)
 
 		testBody(tt, stor)
 	})
@@ -428,9 +494,1082 @@ func TestDeleteEndpoint(t *testing.T) {
 	// 	// defer CleanDB()
 
 	// 	dbContext := context.Background()
-	// 	stor, err := storage.InitV2(endpointURL, dbContext, connString)
+	// 	stor, err := storage.InitV2(endpointURL, dbContext, connString, idGen, storage.DedupeGlobal)
 	// 	require.NoError(tt, err)
 
 	// 	testBody(tt, stor)
 	// })
 }
+
+func TestAliasEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.Default()
+	handler.InitShortenerHandlers(router, initV1(t), handler.Options{})
+
+	shorten := func(request handler.MakeShortPostEndpointRequest) (int, string) {
+		bytesRequest, err := json.Marshal(request)
+		require.NoError(t, err)
+
+		req, err := http.NewRequest(http.MethodPost, endpointURL+"/api/shorten", bytes.NewReader(bytesRequest))
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		resp := recorder.Result()
+		defer resp.Body.Close()
+
+		respObj := handler.MakeShortPostEndpointResponse{}
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		json.Unmarshal(bodyBytes, &respObj)
+
+		return resp.StatusCode, respObj.Result
+	}
+
+	originalURL := "http://oknetcumk.biz/spring"
+
+	request := handler.MakeShortPostEndpointRequest{URL: originalURL}
+	request.Alias = "spring-sale"
+
+	status, shortURL := shorten(request)
+	require.Equal(t, http.StatusCreated, status)
+	require.Equal(t, endpointURL+"/spring-sale", shortURL)
+
+	CheckRedirect(t, shortURL, originalURL, router.ServeHTTP)
+
+	status, shortURL = shorten(request)
+	require.Equal(t, http.StatusConflict, status)
+	require.Equal(t, endpointURL+"/spring-sale", shortURL)
+
+	request.URL = "http://oknetcumk.biz/autumn"
+	status, shortURL = shorten(request)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, "", shortURL)
+
+	request.Alias = "API"
+	status, _ = shorten(request)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	request.Alias = "spring sale"
+	status, _ = shorten(request)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	req, err := http.NewRequest(http.MethodPost, endpointURL+"/api/shorten", strings.NewReader(`{"url":"http://oknetcumk.biz/winter","alias":"API"}`))
+	require.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	errResp := handler.ErrorResponse{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &errResp))
+	require.Equal(t, handler.ErrReservedAlias.Error(), errResp.Error)
+}
+
+func TestLinkStatsEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor := initV1(t)
+	recorder := clicks.NewRecorder(stor, "salt", 16, 16, time.Hour)
+
+	router := gin.Default()
+	router.Use(handler.UseCookieMiddlware(sessionCodec, stor))
+	handler.InitShortenerHandlers(router, stor, handler.Options{Clicks: recorder})
+
+	cookie := SessionCookie(t, "some_token")
+
+	originalURL := "http://oknetcumk.biz/" + t.Name()
+	shortURL := ""
+
+	{
+		req, err := http.NewRequest(http.MethodPost, endpointURL+"/", bytes.NewReader([]byte(originalURL)))
+		require.NoError(t, err)
+		req.AddCookie(cookie)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		resp := recorder.Result()
+		defer resp.Body.Close()
+
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		shortURL = string(bodyBytes)
+	}
+
+	for _, referrer := range []string{"http://a.biz", "http://b.biz", "http://a.biz"} {
+		req, err := http.NewRequest(http.MethodGet, shortURL, nil)
+		require.NoError(t, err)
+		req.Header.Set("Referer", referrer)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		require.Equal(t, http.StatusTemporaryRedirect, recorder.Code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	recorder.Run(ctx)
+
+	getStats := func(cookie *http.Cookie) *http.Response {
+		shortURLId := shortURL[len(endpointURL)+1:]
+		req, err := http.NewRequest(http.MethodGet, endpointURL+"/api/user/urls/"+shortURLId+"/stats", nil)
+		require.NoError(t, err)
+		req.AddCookie(cookie)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Result()
+	}
+
+	resp := getStats(cookie)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	stats := storage.LinkStats{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+
+	assert.Equal(t, 3, stats.Total)
+	assert.Equal(t, 1, stats.UniqueVisitors)
+	require.Equal(t, 1, len(stats.Daily))
+	assert.Equal(t, 3, stats.Daily[0].Clicks)
+	require.Equal(t, 2, len(stats.TopReferrers))
+	assert.Equal(t, storage.ReferrerClicks{Referrer: "http://a.biz", Clicks: 2}, stats.TopReferrers[0])
+
+	otherResp := getStats(SessionCookie(t, "other_token"))
+	defer otherResp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, otherResp.StatusCode)
+}
+
+func TestSessionCookie(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor := initV1(t)
+
+	router := gin.Default()
+	router.Use(handler.UseCookieMiddlware(sessionCodec, stor))
+	handler.InitShortenerHandlers(router, stor, handler.Options{})
+
+	getArchive := func(cookie *http.Cookie) int {
+		req, err := http.NewRequest(http.MethodGet, endpointURL+"/api/user/urls", nil)
+		require.NoError(t, err)
+		req.AddCookie(cookie)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	var issued *http.Cookie
+
+	{
+		req, err := http.NewRequest(http.MethodPost, endpointURL+"/", bytes.NewReader([]byte("http://oknetcumk.biz/1")))
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		resp := recorder.Result()
+		defer resp.Body.Close()
+
+		require.Equal(t, 1, len(resp.Cookies()))
+		issued = resp.Cookies()[0]
+		assert.Equal(t, handler.SessionTokenName, issued.Name)
+		assert.Equal(t, true, issued.HttpOnly)
+	}
+
+	assert.Equal(t, http.StatusOK, getArchive(issued))
+
+	forged := *issued
+	forged.Value = forged.Value[:len(forged.Value)-2] + "AA"
+	assert.Equal(t, http.StatusUnauthorized, getArchive(&forged))
+
+	assert.Equal(t, http.StatusUnauthorized, getArchive(&http.Cookie{Name: handler.SessionTokenName, Value: "some_token"}))
+
+	// The other routes replace the broken cookie with a new session.
+	req, err := http.NewRequest(http.MethodPost, endpointURL+"/", bytes.NewReader([]byte("http://oknetcumk.biz/2")))
+	require.NoError(t, err)
+	req.AddCookie(&forged)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	resp := recorder.Result()
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, 1, len(resp.Cookies()))
+
+	renewed := resp.Cookies()[0]
+	assert.NotEqual(t, issued.Value, renewed.Value)
+	assert.Equal(t, http.StatusOK, getArchive(renewed))
+	assert.Equal(t, http.StatusOK, getArchive(issued))
+}
+
+func TestAPIKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor := initV1(t)
+
+	router := gin.Default()
+	router.Use(handler.UseCookieMiddlware(sessionCodec, stor))
+	handler.InitShortenerHandlers(router, stor, handler.Options{})
+
+	userCookie := SessionCookie(t, "some_user")
+
+	created := handler.CreateAPIKeyResponse{}
+	{
+		req, err := http.NewRequest(http.MethodPost, endpointURL+"/api/user/keys", bytes.NewReader([]byte(`{"name":"ci"}`)))
+		require.NoError(t, err)
+		req.AddCookie(userCookie)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		require.Equal(t, http.StatusCreated, recorder.Code)
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &created))
+		require.Equal(t, "ci", created.Name)
+		require.NotEqual(t, "", created.Key)
+	}
+
+	withKey := func(method, path string, body []byte, key string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, endpointURL+path, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+key)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	{
+		batch := []byte(`[{"correlation_id":"1","original_url":"http://oknetcumk.biz/1"}]`)
+		recorder := withKey(http.MethodPost, "/api/shorten/batch", batch, created.Key)
+		require.Equal(t, http.StatusCreated, recorder.Code)
+		require.Equal(t, 0, len(recorder.Result().Cookies()))
+
+		archive, err := stor.GetUserArchive(ctx, "some_user", storage.ArchiveOptions{})
+		require.NoError(t, err)
+		require.Equal(t, 1, len(archive.URLs))
+	}
+
+	{
+		recorder := withKey(http.MethodGet, "/api/user/keys", nil, created.Key)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		keys := make([]storage.APIKey, 0)
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &keys))
+		require.Equal(t, 1, len(keys))
+		require.Equal(t, created.ID, keys[0].ID)
+	}
+
+	require.Equal(t, http.StatusNoContent, withKey(http.MethodDelete, "/api/user/keys/"+created.ID, nil, created.Key).Code)
+	require.Equal(t, http.StatusUnauthorized, withKey(http.MethodGet, "/api/user/urls", nil, created.Key).Code)
+
+	{
+		req, err := http.NewRequest(http.MethodDelete, endpointURL+"/api/user/keys/"+created.ID, nil)
+		require.NoError(t, err)
+		req.AddCookie(userCookie)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		require.Equal(t, http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestMakeShortsStreamEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor := initV1(t)
+
+	router := gin.Default()
+	router.Use(handler.UseTimeoutMiddleware(time.Second))
+	router.Use(handler.UseCookieMiddlware(sessionCodec, stor))
+	handler.InitShortenerHandlers(router, stor, handler.Options{})
+
+	body := &bytes.Buffer{}
+	gWriter := gzip.NewWriter(body)
+	gWriter.Write([]byte(`{"correlation_id":"1","original_url":"http://oknetcumk.biz/1"}` + "\n"))
+	gWriter.Write([]byte("not a json\n\n"))
+	gWriter.Write([]byte(`{"correlation_id":"3","original_url":"http://oknetcumk.biz/1"}` + "\n"))
+	require.NoError(t, gWriter.Close())
+
+	req, err := http.NewRequest(http.MethodPost, endpointURL+"/api/shorten/stream", body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", handler.NDJSONContentType)
+	req.Header.Set("Content-Encoding", "gzip")
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, handler.NDJSONContentType, recorder.Header().Get("Content-Type"))
+
+	responseBody := make([]handler.MakeShortsPostEndpointResponse, 0)
+	decoder := json.NewDecoder(recorder.Body)
+	for decoder.More() {
+		item := handler.MakeShortsPostEndpointResponse{}
+		require.NoError(t, decoder.Decode(&item))
+		responseBody = append(responseBody, item)
+	}
+
+	require.Equal(t, 3, len(responseBody))
+	assert.Equal(t, handler.BatchStatusCreated, responseBody[0].Status)
+	assert.Equal(t, handler.BatchStatusInvalid, responseBody[1].Status)
+	assert.Equal(t, handler.BatchStatusExisting, responseBody[2].Status)
+	assert.Equal(t, responseBody[0].ShortURL, responseBody[2].ShortURL)
+
+	req, err = http.NewRequest(http.MethodPost, endpointURL+"/api/shorten/stream", bytes.NewReader([]byte("[]")))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, recorder.Code)
+}
+
+func TestMakeShortsStreamEndpointServer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	const linesCount = 2500
+
+	router := gin.Default()
+	handler.InitShortenerHandlers(router, initV1(t), handler.Options{})
+
+	server := httptest.NewServer(handler.WithResponseController(router))
+	defer server.Close()
+
+	writeLine := func(w io.Writer, i int) error {
+		_, err := fmt.Fprintf(w, `{"correlation_id":"%d","original_url":"http://oknetcumk.biz/stream/%d"}`+"\n", i, i)
+		return err
+	}
+
+	// The body of an unknown length is sent chunked.
+	bodyReader, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/api/shorten/stream", bodyReader)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", handler.NDJSONContentType)
+
+	go writeLine(bodyWriter, 0)
+
+	resp, err := server.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The first line is answered while the upload goes on.
+	decoder := json.NewDecoder(resp.Body)
+	item := handler.MakeShortsPostEndpointResponse{}
+	require.NoError(t, decoder.Decode(&item))
+	require.Equal(t, "0", item.CorrelationID)
+	require.Equal(t, handler.BatchStatusCreated, item.Status)
+
+	go func() {
+		for i := 1; i < linesCount; i++ {
+			if writeLine(bodyWriter, i) != nil {
+				return
+			}
+		}
+
+		bodyWriter.Close()
+	}()
+
+	for i := 1; i < linesCount; i++ {
+		item = handler.MakeShortsPostEndpointResponse{}
+		require.NoError(t, decoder.Decode(&item))
+		require.Equal(t, fmt.Sprint(i), item.CorrelationID)
+		require.Equal(t, handler.BatchStatusCreated, item.Status)
+	}
+
+	require.False(t, decoder.More())
+}
+
+func TestRestoreEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor := initV1(t)
+
+	router := gin.Default()
+	router.Use(handler.UseCookieMiddlware(sessionCodec, stor))
+	handler.InitShortenerHandlers(router, stor, handler.Options{})
+
+	cookie := SessionCookie(t, "some_token")
+	originalURL := "http://oknetcumk.biz/" + t.Name()
+
+	shortURL, err := stor.ShortenURL(ctx, originalURL, "some_token", storage.ShortenOptions{})
+	require.NoError(t, err)
+	shortURLId := shortURL[len(endpointURL)+1:]
+
+	send := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		bodyBytes, err := json.Marshal(body)
+		require.NoError(t, err)
+
+		req, err := http.NewRequest(method, endpointURL+path, bytes.NewReader(bodyBytes))
+		require.NoError(t, err)
+		req.AddCookie(cookie)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	require.Equal(t, http.StatusAccepted, send(http.MethodDelete, "/api/user/urls", []string{shortURLId}).Code)
+
+	archive := []storage.UserUrls{}
+	recorder := send(http.MethodGet, "/api/user/urls", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &archive))
+	require.Equal(t, 0, len(archive))
+
+	recorder = send(http.MethodGet, "/api/user/urls?include_deleted=true", nil)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &archive))
+	require.Equal(t, 1, len(archive))
+	require.Equal(t, originalURL, archive[0].OriginalURL)
+	require.NotNil(t, archive[0].DeletedAt)
+
+	require.Equal(t, http.StatusBadRequest, send(http.MethodGet, "/api/user/urls?include_deleted=maybe", nil).Code)
+
+	recorder = send(http.MethodPost, "/api/user/urls/restore", []string{shortURLId})
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	restored := []string{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &restored))
+	require.Equal(t, []string{shortURLId}, restored)
+
+	_, err = stor.GetOriginalURL(ctx, shortURLId, "some_token")
+	require.NoError(t, err)
+}
+
+func TestRestoreQueuedDeletion(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor := initV1(t)
+	deletions := deletion.NewQueue(stor, 1, deletion.DefaultBufferSize, deletion.DefaultBatchSize, time.Hour)
+
+	router := gin.Default()
+	router.Use(handler.UseCookieMiddlware(sessionCodec, stor))
+	handler.InitShortenerHandlers(router, stor, handler.Options{Deletions: deletions})
+
+	cookie := SessionCookie(t, "some_token")
+
+	shortURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/"+t.Name(), "some_token", storage.ShortenOptions{})
+	require.NoError(t, err)
+	shortURLId := shortURL[len(endpointURL)+1:]
+
+	send := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		bodyBytes, err := json.Marshal(body)
+		require.NoError(t, err)
+
+		req, err := http.NewRequest(method, endpointURL+path, bytes.NewReader(bodyBytes))
+		require.NoError(t, err)
+		req.AddCookie(cookie)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// The deletion is still in the queue when the restore comes.
+	require.Equal(t, http.StatusAccepted, send(http.MethodDelete, "/api/user/urls", []string{shortURLId}).Code)
+
+	recorder := send(http.MethodPost, "/api/user/urls/restore", []string{shortURLId})
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	restored := []string{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &restored))
+	require.Equal(t, []string{shortURLId}, restored)
+
+	drain := func() {
+		runCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		deletions.Run(runCtx)
+	}
+
+	drain()
+
+	_, err = stor.GetOriginalURL(ctx, shortURLId, "some_token")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), deletions.Metrics().Canceled)
+
+	// The deletion sent after the restore is not canceled.
+	require.Equal(t, http.StatusAccepted, send(http.MethodDelete, "/api/user/urls", []string{shortURLId}).Code)
+	drain()
+
+	_, err = stor.GetOriginalURL(ctx, shortURLId, "some_token")
+	require.ErrorIs(t, err, storage.ErrValueGone)
+}
+
+func TestGetUsersArchivePages(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor := initV1(t)
+
+	router := gin.Default()
+	router.Use(handler.UseCookieMiddlware(sessionCodec, stor))
+	handler.InitShortenerHandlers(router, stor, handler.Options{})
+
+	cookie := SessionCookie(t, "some_token")
+	for i := 0; i < 3; i++ {
+		_, err := stor.ShortenURL(ctx, fmt.Sprintf("http://oknetcumk.biz/%s/%d", t.Name(), i), "some_token", storage.ShortenOptions{})
+		require.NoError(t, err)
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodGet, endpointURL+"/api/user/urls"+query, nil)
+		require.NoError(t, err)
+		req.AddCookie(cookie)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	page := storage.ArchivePage{}
+	recorder := get("?limit=2&sort=clicks&order=asc")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &page))
+	require.Equal(t, 2, len(page.URLs))
+	require.NotEmpty(t, page.NextCursor)
+
+	recorder = get("?sort=clicks&order=asc&cursor=" + page.NextCursor)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	page = storage.ArchivePage{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &page))
+	require.Equal(t, 1, len(page.URLs))
+	require.Empty(t, page.NextCursor)
+
+	urls := []handler.UserUrls{}
+	recorder = get("?q=/1")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &urls))
+	require.Equal(t, 1, len(urls))
+
+	for _, query := range []string{"?limit=0", "?limit=1001", "?sort=name", "?order=up", "?cursor=bad"} {
+		require.Equal(t, http.StatusBadRequest, get(query).Code, query)
+	}
+}
+
+func TestLinkMetadata(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor := initV1(t)
+
+	router := gin.Default()
+	router.Use(handler.UseCookieMiddlware(sessionCodec, stor))
+	handler.InitShortenerHandlers(router, stor, handler.Options{})
+
+	cookie := SessionCookie(t, "some_token")
+
+	shorten := func(request handler.MakeShortPostEndpointRequest) int {
+		bytesRequest, err := json.Marshal(request)
+		require.NoError(t, err)
+
+		req, err := http.NewRequest(http.MethodPost, endpointURL+"/api/shorten", bytes.NewReader(bytesRequest))
+		require.NoError(t, err)
+		req.AddCookie(cookie)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	request := handler.MakeShortPostEndpointRequest{URL: "http://oknetcumk.biz/" + t.Name()}
+	request.Title = "Spring sale"
+	request.Description = "Landing page of the spring sale"
+	require.Equal(t, http.StatusCreated, shorten(request))
+
+	req, err := http.NewRequest(http.MethodGet, endpointURL+"/api/user/urls", nil)
+	require.NoError(t, err)
+	req.AddCookie(cookie)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	urls := []handler.UserUrls{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &urls))
+	require.Equal(t, 1, len(urls))
+	require.Equal(t, "Spring sale", urls[0].Title)
+	require.Equal(t, "Landing page of the spring sale", urls[0].Description)
+	require.Equal(t, "some_token", urls[0].CreatedBy)
+	require.False(t, urls[0].CreatedAt.IsZero())
+	require.Equal(t, urls[0].CreatedAt, urls[0].UpdatedAt)
+
+	request.URL = "http://oknetcumk.biz/" + t.Name() + "/long"
+	request.Title = strings.Repeat("a", 257)
+	require.Equal(t, http.StatusBadRequest, shorten(request))
+}
+
+func TestLinkLabelsEndpoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor := initV1(t)
+
+	router := gin.Default()
+	router.Use(handler.UseCookieMiddlware(sessionCodec, stor))
+	handler.InitShortenerHandlers(router, stor, handler.Options{})
+
+	cookie := SessionCookie(t, "some_token")
+
+	shortURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/"+t.Name(), "some_token", storage.ShortenOptions{})
+	require.NoError(t, err)
+	shortURLId := shortURL[len(endpointURL)+1:]
+
+	send := func(method, path string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, endpointURL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.AddCookie(cookie)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	tagsPath := "/api/user/urls/" + shortURLId + "/tags"
+
+	recorder := send(http.MethodPost, tagsPath, `[" Sale ", "sale", "spring"]`)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.JSONEq(t, `["sale", "spring"]`, recorder.Body.String())
+
+	recorder = send(http.MethodDelete, tagsPath, `["SPRING"]`)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.JSONEq(t, `["sale"]`, recorder.Body.String())
+
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPost, tagsPath, `[""]`).Code)
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPost, tagsPath, `"sale"`).Code)
+	require.Equal(t, http.StatusNotFound, send(http.MethodPost, "/api/user/urls/unknown/tags", `["sale"]`).Code)
+
+	folderPath := "/api/user/urls/" + shortURLId + "/folder"
+	require.Equal(t, http.StatusNoContent, send(http.MethodPut, folderPath, `{"folder":"campaigns"}`).Code)
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPut, folderPath, `{"folder":"`+strings.Repeat("a", 129)+`"}`).Code)
+
+	urls := []handler.UserUrls{}
+	recorder = send(http.MethodGet, "/api/user/urls?tag=Sale&folder=campaigns", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &urls))
+	require.Equal(t, 1, len(urls))
+	require.Equal(t, []string{"sale"}, urls[0].Tags)
+	require.Equal(t, "campaigns", urls[0].Folder)
+
+	recorder = send(http.MethodGet, "/api/user/urls?folder=other", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.JSONEq(t, `[]`, recorder.Body.String())
+}
+
+func TestURLPolicy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.Default()
+	handler.InitShortenerHandlers(router, initV1(t), handler.Options{})
+
+	send := func(path string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodPost, endpointURL+path, strings.NewReader(body))
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	for _, body := range []string{"", "  ", "qwe", "javascript:alert(1)", "ftp://oknetcumk.biz/"} {
+		recorder := send("/", body)
+		require.Equal(t, http.StatusBadRequest, recorder.Code, body)
+		require.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+		errResp := handler.ErrorResponse{}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &errResp))
+		require.NotEmpty(t, errResp.Error)
+	}
+
+	recorder := send("/", " HTTP://OKNETCUMK.biz:80 \n")
+	require.Equal(t, http.StatusCreated, recorder.Code)
+	shortURL := recorder.Body.String()
+
+	CheckRedirect(t, shortURL, "http://oknetcumk.biz/", router.ServeHTTP)
+
+	recorder = send("/api/shorten", `{"url":"http://oknetcumk.biz/"}`)
+	require.Equal(t, http.StatusConflict, recorder.Code)
+
+	resp := handler.MakeShortPostEndpointResponse{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+	require.Equal(t, shortURL, resp.Result)
+
+	require.Equal(t, http.StatusBadRequest, send("/api/shorten", `{"url":"javascript:alert(1)"}`).Code)
+
+	recorder = send("/api/shorten/batch", `[{"correlation_id":"1","original_url":"qwe"},{"correlation_id":"2","original_url":"http://OKNETCUMK.biz"}]`)
+	require.Equal(t, http.StatusMultiStatus, recorder.Code)
+
+	batch := []handler.MakeShortsPostEndpointResponse{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &batch))
+	require.Equal(t, handler.BatchStatusInvalid, batch[0].Status)
+	require.Equal(t, handler.BatchStatusExisting, batch[1].Status)
+	require.Equal(t, shortURL, batch[1].ShortURL)
+}
+
+func TestBlocklist(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	blocked, err := blocklist.New("")
+	require.NoError(t, err)
+	require.NoError(t, blocked.Add("phishing.biz"))
+
+	router := gin.Default()
+	handler.InitShortenerHandlers(router, initV1(t), handler.Options{
+		Blocklist:  blocked,
+		AdminToken: "admin_token",
+	})
+
+	send := func(method, path, body, adminToken string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, endpointURL+path, strings.NewReader(body))
+		require.NoError(t, err)
+
+		if adminToken != "" {
+			req.Header.Set(handler.AdminTokenHeader, adminToken)
+		}
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := send(http.MethodPost, "/", "http://login.PHISHING.biz/bank", "")
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+
+	errResp := handler.ErrorResponse{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &errResp))
+	require.Equal(t, blocklist.ErrBlocked.Error(), errResp.Error)
+
+	require.Equal(t, http.StatusForbidden, send(http.MethodPost, "/api/shorten", `{"url":"http://phishing.biz"}`, "").Code)
+
+	recorder = send(http.MethodPost, "/api/shorten/batch", `[{"correlation_id":"1","original_url":"http://phishing.biz/"}]`, "")
+	require.Equal(t, http.StatusMultiStatus, recorder.Code)
+
+	batch := []handler.MakeShortsPostEndpointResponse{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &batch))
+	require.Equal(t, handler.BatchStatusInvalid, batch[0].Status)
+	require.Equal(t, blocklist.ErrBlocked.Error(), batch[0].Message)
+
+	recorder = send(http.MethodPost, "/", "http://oknetcumk.biz/promo", "")
+	require.Equal(t, http.StatusCreated, recorder.Code)
+	shortURL := recorder.Body.String()
+
+	CheckRedirect(t, shortURL, "http://oknetcumk.biz/promo", router.ServeHTTP)
+
+	require.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/api/admin/blocklist", "", "").Code)
+	require.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/api/admin/blocklist", "", "wrong").Code)
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/api/admin/blocklist", `[""]`, "admin_token").Code)
+
+	recorder = send(http.MethodPost, "/api/admin/blocklist", `["http://oknetcumk.biz/promo*"]`, "admin_token")
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	entries := []string{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &entries))
+	require.Equal(t, []string{"http://oknetcumk.biz/promo*", "phishing.biz"}, entries)
+
+	req, err := http.NewRequest(http.MethodGet, shortURL, nil)
+	require.NoError(t, err)
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusUnavailableForLegalReasons, recorder.Code)
+	require.Empty(t, recorder.Header().Get("Location"))
+
+	recorder = send(http.MethodDelete, "/api/admin/blocklist", `["http://oknetcumk.biz/promo*"]`, "admin_token")
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	CheckRedirect(t, shortURL, "http://oknetcumk.biz/promo", router.ServeHTTP)
+
+	recorder = send(http.MethodGet, "/api/admin/blocklist", "", "admin_token")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &entries))
+	require.Equal(t, []string{"phishing.biz"}, entries)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stor := initV1(t)
+	deletions := deletion.NewQueue(stor, deletion.DefaultWorkers, deletion.DefaultBufferSize, deletion.DefaultBatchSize, deletion.DefaultFlushInterval)
+
+	router := gin.Default()
+	router.Use(handler.UseCookieMiddlware(sessionCodec, stor))
+	handler.InitShortenerHandlers(router, stor, handler.Options{Deletions: deletions, AdminToken: "admin_token"})
+
+	send := func(method, path string, body string, cookie *http.Cookie, adminToken string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, endpointURL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		if adminToken != "" {
+			req.Header.Set(handler.AdminTokenHeader, adminToken)
+		}
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	require.Equal(t, http.StatusAccepted, send(http.MethodDelete, "/api/user/urls", `["some_id"]`, SessionCookie(t, "some_token"), "").Code)
+
+	require.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/api/admin/metrics", "", nil, "").Code)
+	require.Equal(t, http.StatusNotFound, send(http.MethodGet, "/debug/vars", "", nil, "admin_token").Code)
+
+	recorder := send(http.MethodGet, "/api/admin/metrics", "", nil, "admin_token")
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	metrics := handler.MetricsResponse{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &metrics))
+	require.Equal(t, int64(1), metrics.DeletionQueue.Enqueued)
+}
+
+func TestLoopProtection(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	loops, err := loopguard.New(endpointURL, []string{"bit.ly"})
+	require.NoError(t, err)
+
+	router := gin.Default()
+	handler.InitShortenerHandlers(router, initV1(t), handler.Options{Loops: loops})
+
+	send := func(path string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodPost, endpointURL+path, strings.NewReader(body))
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := send("/", "http://oknetcumk.biz/target")
+	require.Equal(t, http.StatusCreated, recorder.Code)
+	shortURL := recorder.Body.String()
+
+	recorder = send("/", shortURL)
+	require.Equal(t, http.StatusConflict, recorder.Code)
+	require.Equal(t, shortURL, recorder.Body.String())
+
+	recorder = send("/api/shorten", fmt.Sprintf(`{"url":%q}`, shortURL))
+	require.Equal(t, http.StatusConflict, recorder.Code)
+
+	resp := handler.MakeShortPostEndpointResponse{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+	require.Equal(t, shortURL, resp.Result)
+	CheckRedirect(t, resp.Result, "http://oknetcumk.biz/target", router.ServeHTTP)
+
+	for _, body := range []string{endpointURL + "/missing", endpointURL + "/api/user/urls", "https://bit.ly/abc"} {
+		recorder = send("/", body)
+		require.Equal(t, http.StatusBadRequest, recorder.Code, body)
+
+		errResp := handler.ErrorResponse{}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &errResp))
+		require.NotEmpty(t, errResp.Error)
+	}
+
+	batchBody := fmt.Sprintf(`[{"correlation_id":"1","original_url":%q},{"correlation_id":"2","original_url":"https://bit.ly/abc"}]`, shortURL)
+	recorder = send("/api/shorten/batch", batchBody)
+	require.Equal(t, http.StatusMultiStatus, recorder.Code)
+
+	batch := []handler.MakeShortsPostEndpointResponse{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &batch))
+	require.Equal(t, handler.BatchStatusExisting, batch[0].Status)
+	require.Equal(t, shortURL, batch[0].ShortURL)
+	require.Equal(t, handler.BatchStatusInvalid, batch[1].Status)
+	require.Equal(t, loopguard.ErrShortenerURL.Error(), batch[1].Message)
+}
+
+// lookupFailingStorage fails to look up the original URLs.
+type lookupFailingStorage struct {
+	storage.Interface
+}
+
+var errLookupFailed = errors.New("lookup failed")
+
+func (s lookupFailingStorage) GetOriginalURL(ctx context.Context, shortURLId string, userUUID string) (string, error) {
+	return "", errLookupFailed
+}
+
+func TestBatchCheckError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	loops, err := loopguard.New(endpointURL, nil)
+	require.NoError(t, err)
+
+	router := gin.Default()
+	handler.InitShortenerHandlers(router, lookupFailingStorage{initV1(t)}, handler.Options{Loops: loops})
+
+	body := fmt.Sprintf(`[{"correlation_id":"1","original_url":"%s/some_id"},{"correlation_id":"2","original_url":"oknetcumk"}]`, endpointURL)
+	req, err := http.NewRequest(http.MethodPost, endpointURL+"/api/shorten/batch", strings.NewReader(body))
+	require.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusMultiStatus, recorder.Code)
+
+	batch := []handler.MakeShortsPostEndpointResponse{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &batch))
+	require.Equal(t, handler.BatchStatusError, batch[0].Status)
+	require.Equal(t, errLookupFailed.Error(), batch[0].Message)
+	require.Equal(t, handler.BatchStatusInvalid, batch[1].Status)
+}
+
+func TestQRCodeEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.Default()
+	handler.InitShortenerHandlers(router, initV1(t), handler.Options{
+		QRCodes: qr.NewCache(qr.DefaultCacheSize),
+		BaseURL: endpointURL,
+	})
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, endpointURL+path, strings.NewReader(body))
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := send(http.MethodPost, "/", "http://oknetcumk.biz/print")
+	require.Equal(t, http.StatusCreated, recorder.Code)
+	shortURLId := strings.TrimPrefix(recorder.Body.String(), endpointURL+"/")
+
+	recorder = send(http.MethodGet, "/"+shortURLId+"/qr", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "image/png", recorder.Header().Get("Content-Type"))
+
+	expected, err := qr.Render(endpointURL+"/"+shortURLId, qr.DefaultOptions())
+	require.NoError(t, err)
+	require.Equal(t, expected, recorder.Body.Bytes())
+
+	recorder = send(http.MethodGet, "/"+shortURLId+"/qr?format=svg&size=512&level=h&margin=2", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "image/svg+xml", recorder.Header().Get("Content-Type"))
+	require.Contains(t, recorder.Body.String(), `width="512"`)
+
+	for _, query := range []string{"format=gif", "size=big", "size=10", "level=X", "margin=-1", "margin=x"} {
+		recorder = send(http.MethodGet, "/"+shortURLId+"/qr?"+query, "")
+		require.Equal(t, http.StatusBadRequest, recorder.Code, query)
+	}
+
+	require.Equal(t, http.StatusNotFound, send(http.MethodGet, "/missing/qr", "").Code)
+
+	recorder = send(http.MethodPost, "/api/shorten/batch?include_qr=true&format=svg", `[{"correlation_id":"1","original_url":"http://oknetcumk.biz/print"},{"correlation_id":"2","original_url":"qwe"}]`)
+	require.Equal(t, http.StatusMultiStatus, recorder.Code)
+
+	batch := []handler.MakeShortsPostEndpointResponse{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &batch))
+	require.True(t, strings.HasPrefix(batch[0].QR, "data:image/svg+xml;base64,"))
+	require.Empty(t, batch[1].QR)
+
+	recorder = send(http.MethodPost, "/api/shorten/batch", `[{"correlation_id":"1","original_url":"http://oknetcumk.biz/print"}]`)
+	batch = []handler.MakeShortsPostEndpointResponse{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &batch))
+	require.Empty(t, batch[0].QR)
+
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/api/shorten/batch?include_qr=yes", `[]`).Code)
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/api/shorten/batch?include_qr=1&size=1", `[]`).Code)
+}
+
+func TestPreviewEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	previews, err := preview.New("")
+	require.NoError(t, err)
+
+	stor := initV1(t)
+
+	router := gin.Default()
+	handler.InitShortenerHandlers(router, stor, handler.Options{Previews: previews})
+
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	checkPreview := func(url string) {
+		recorder := send(http.MethodGet, url, "")
+		require.Equal(t, http.StatusOK, recorder.Code, url)
+		require.Equal(t, "text/html; charset=utf-8", recorder.Header().Get("Content-Type"))
+		require.Empty(t, recorder.Header().Get("Location"))
+		require.Contains(t, recorder.Body.String(), "oknetcumk.biz")
+	}
+
+	recorder := send(http.MethodPost, endpointURL+"/api/shorten", `{"url":"http://oknetcumk.biz/plain"}`)
+	require.Equal(t, http.StatusCreated, recorder.Code)
+
+	resp := handler.MakeShortPostEndpointResponse{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+	plainURL := resp.Result
+
+	CheckRedirect(t, plainURL, "http://oknetcumk.biz/plain", router.ServeHTTP)
+	CheckRedirect(t, plainURL+"?preview=0", "http://oknetcumk.biz/plain", router.ServeHTTP)
+	checkPreview(plainURL + "+")
+	checkPreview(plainURL + "?preview=1")
+	require.Equal(t, http.StatusBadRequest, send(http.MethodGet, plainURL+"?preview=maybe", "").Code)
+	require.Equal(t, http.StatusBadRequest, send(http.MethodGet, endpointURL+"/missing+", "").Code)
+
+	recorder = send(http.MethodPost, endpointURL+"/api/shorten", `{"url":"http://oknetcumk.biz/sale","title":"Spring <sale>","preview":true}`)
+	require.Equal(t, http.StatusCreated, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+
+	checkPreview(resp.Result)
+	checkPreview(resp.Result + "?preview=0")
+	require.Contains(t, send(http.MethodGet, resp.Result, "").Body.String(), "Spring &lt;sale&gt;")
+
+	router = gin.Default()
+	handler.InitShortenerHandlers(router, stor, handler.Options{Previews: previews, PreviewAll: true})
+	checkPreview(plainURL)
+
+	router = gin.Default()
+	handler.InitShortenerHandlers(router, stor, handler.Options{})
+	CheckRedirect(t, resp.Result, "http://oknetcumk.biz/sale", router.ServeHTTP)
+}
+
+func TestPreviewClicks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	previews, err := preview.New("")
+	require.NoError(t, err)
+
+	stor := initV1(t)
+	recorder := clicks.NewRecorder(stor, "salt", 16, 16, time.Hour)
+
+	router := gin.Default()
+	handler.InitShortenerHandlers(router, stor, handler.Options{Clicks: recorder, Previews: previews})
+
+	previewURL, err := stor.ShortenURL(context.Background(), "http://oknetcumk.biz/preview", "some_token", storage.ShortenOptions{Preview: true})
+	require.NoError(t, err)
+	plainURL, err := stor.ShortenURL(context.Background(), "http://oknetcumk.biz/plain", "some_token", storage.ShortenOptions{})
+	require.NoError(t, err)
+
+	for _, url := range []string{previewURL, plainURL + "+"} {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		require.Equal(t, http.StatusOK, recorder.Code, url)
+	}
+
+	CheckRedirect(t, plainURL, "http://oknetcumk.biz/plain", router.ServeHTTP)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	recorder.Run(ctx)
+
+	// Only the redirect is counted, the visitors may not leave the preview
+	// page.
+	stats, err := stor.GetLinkStats(context.Background(), strings.TrimPrefix(previewURL, endpointURL+"/"), "some_token")
+	require.NoError(t, err)
+	require.Equal(t, 0, stats.Total)
+
+	stats, err = stor.GetLinkStats(context.Background(), strings.TrimPrefix(plainURL, endpointURL+"/"), "some_token")
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Total)
+}
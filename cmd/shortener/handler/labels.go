@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/GermanVor/shortener-pet-project/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// Limits of the link tags and folders in characters.
+const (
+	maxTagLength    = 64
+	maxTagsCount    = 32
+	maxFolderLength = 128
+)
+
+var ErrBadTag = fmt.Errorf("tags must be 1-%d characters", maxTagLength)
+var ErrManyTags = fmt.Errorf("at most %d tags can be changed at once", maxTagsCount)
+var ErrLongFolder = fmt.Errorf("folder must be at most %d characters", maxFolderLength)
+
+type MoveToFolderRequest struct {
+	Folder string `json:"folder"`
+}
+
+// NormalizeTag trims and lowercases the tag, so the tags differing in case
+// are the same.
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// NormalizeTags normalizes the tags dropping the repeated ones.
+func NormalizeTags(tags []string) ([]string, error) {
+	if len(tags) > maxTagsCount {
+		return nil, ErrManyTags
+	}
+
+	res := make([]string, 0, len(tags))
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = NormalizeTag(tag)
+		if tag == "" || utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, ErrBadTag
+		}
+
+		if !seen[tag] {
+			seen[tag] = true
+			res = append(res, tag)
+		}
+	}
+
+	return res, nil
+}
+
+func NormalizeFolder(folder string) (string, error) {
+	folder = strings.TrimSpace(folder)
+	if utf8.RuneCountInString(folder) > maxFolderLength {
+		return "", ErrLongFolder
+	}
+
+	return folder, nil
+}
+
+// ChangeTagsEndpoint adds or removes the tags of the user link depending on
+// the request method, the resulting tags are responded.
+func ChangeTagsEndpoint(ctx *gin.Context, stor storage.Interface) {
+	w := ctx.Writer
+	r := ctx.Request
+
+	userToken := ctx.GetString(SessionTokenName)
+	if userToken == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tags := []string{}
+	if err = json.Unmarshal(bodyBytes, &tags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if tags, err = NormalizeTags(tags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	change := stor.AddTags
+	if r.Method == http.MethodDelete {
+		change = stor.RemoveTags
+	}
+
+	res, err := change(r.Context(), ctx.Param("id"), userToken, tags)
+	if errors.Is(err, storage.ErrValueNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	responseBytes, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseBytes)
+}
+
+// MoveToFolderEndpoint moves the user link to the folder, an empty one moves
+// it out of any folder.
+func MoveToFolderEndpoint(ctx *gin.Context, stor storage.Interface) {
+	w := ctx.Writer
+	r := ctx.Request
+
+	userToken := ctx.GetString(SessionTokenName)
+	if userToken == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	request := &MoveToFolderRequest{}
+	if err = json.Unmarshal(bodyBytes, request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	folder, err := NormalizeFolder(request.Folder)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = stor.MoveToFolder(r.Context(), ctx.Param("id"), userToken, folder)
+	if errors.Is(err, storage.ErrValueNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
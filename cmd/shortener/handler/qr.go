@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/GermanVor/shortener-pet-project/internal/qr"
+	"github.com/GermanVor/shortener-pet-project/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+var ErrBadQRSize = errors.New("size must be an integer")
+var ErrBadQRMargin = errors.New("margin must be an integer")
+
+// parseQROptions reads the format, size, level and margin query parameters,
+// the missing ones are defaulted.
+func parseQROptions(ctx *gin.Context) (qr.Options, error) {
+	opts := qr.DefaultOptions()
+
+	if format, ok := ctx.GetQuery("format"); ok {
+		opts.Format = qr.Format(strings.ToLower(format))
+	}
+
+	if sizeStr, ok := ctx.GetQuery("size"); ok {
+		size, err := strconv.Atoi(sizeStr)
+		if err != nil {
+			return opts, ErrBadQRSize
+		}
+
+		opts.Size = size
+	}
+
+	if level, ok := ctx.GetQuery("level"); ok {
+		opts.Level = strings.ToUpper(level)
+	}
+
+	if marginStr, ok := ctx.GetQuery("margin"); ok {
+		margin, err := strconv.Atoi(marginStr)
+		if err != nil {
+			return opts, ErrBadQRMargin
+		}
+
+		opts.Margin = margin
+	}
+
+	return opts, opts.Validate()
+}
+
+// shortURLBase returns the base URL of the short links, the request host is
+// used when it is not configured.
+func shortURLBase(ctx *gin.Context, baseURL string) string {
+	if baseURL != "" {
+		return baseURL
+	}
+
+	scheme := "http"
+	if ctx.Request.TLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + ctx.Request.Host
+}
+
+// QRCodeEndpoint responds with the QR code of the short link.
+func QRCodeEndpoint(ctx *gin.Context, stor storage.Interface, codes *qr.Cache, baseURL string) {
+	w := ctx.Writer
+	r := ctx.Request
+
+	opts, err := parseQROptions(ctx)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	shortURLId := ctx.Param("id")
+
+	_, err = stor.GetOriginalURL(r.Context(), shortURLId, "")
+	if errors.Is(err, storage.ErrValueNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if errors.Is(err, storage.ErrValueGone) {
+		w.WriteHeader(http.StatusGone)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	image, err := codes.Render(shortURLBase(ctx, baseURL)+"/"+shortURLId, opts)
+	if errors.Is(err, qr.ErrSizeTooSmall) {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", opts.ContentType())
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.WriteHeader(http.StatusOK)
+	w.Write(image)
+}
+
+// addQRCodes puts the QR code data URIs of the shortened items to resp, the
+// items failed to render keep no QR code.
+func addQRCodes(codes *qr.Cache, opts qr.Options, resp []MakeShortsPostEndpointResponse) {
+	for i := range resp {
+		if resp[i].ShortURL == "" {
+			continue
+		}
+
+		if image, err := codes.Render(resp[i].ShortURL, opts); err == nil {
+			resp[i].QR = qr.DataURI(image, opts)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/GermanVor/shortener-pet-project/internal/blocklist"
+	"github.com/GermanVor/shortener-pet-project/internal/loopguard"
+	"github.com/GermanVor/shortener-pet-project/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	NDJSONContentType = "application/x-ndjson"
+
+	// Amount of lines shortened at once.
+	streamChunkSize = 1000
+	// The lines read are shortened at least that often, so the client gets the
+	// results of a slow upload.
+	streamFlushInterval = 100 * time.Millisecond
+	// Lines longer than that stop the stream.
+	maxStreamLineSize = 1 << 20
+)
+
+type responseControllerKey struct{}
+
+// WithResponseController puts the controller of the server response writer
+// into the request context, gin does not expose the writer it wraps.
+func WithResponseController(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), responseControllerKey{}, http.NewResponseController(w))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// enableFullDuplex lets the handler write the response while the request body
+// is read, HTTP/1 servers close the body on the first write otherwise.
+func enableFullDuplex(ctx *gin.Context) error {
+	controller, ok := ctx.Request.Context().Value(responseControllerKey{}).(*http.ResponseController)
+	if !ok {
+		controller = http.NewResponseController(ctx.Writer)
+	}
+
+	return controller.EnableFullDuplex()
+}
+
+// scanLines sends the lines of body to the returned channel until done is
+// closed, the scan error is set before the channel is closed.
+func scanLines(body io.Reader, done <-chan struct{}, scanErr *error) <-chan []byte {
+	lines := make(chan []byte)
+
+	go func() {
+		defer close(lines)
+
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLineSize)
+
+		for scanner.Scan() {
+			line := append([]byte(nil), scanner.Bytes()...)
+
+			select {
+			case lines <- line:
+			case <-done:
+				return
+			}
+		}
+
+		*scanErr = scanner.Err()
+	}()
+
+	return lines
+}
+
+// MakeShortsStreamEndpoint shortens the newline delimited MappingItem objects
+// of the request body, optionally gzipped, by chunks and streams back a
+// MakeShortsPostEndpointResponse line for every item while reading, so the
+// import size is not limited by the memory. A chunk is shortened once full or
+// every streamFlushInterval. A line which is not a valid item gets the invalid
+// status.
+func MakeShortsStreamEndpoint(ctx *gin.Context, stor storage.Interface, blocked *blocklist.List, loops *loopguard.Guard) {
+	w := ctx.Writer
+	r := ctx.Request
+
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != NDJSONContentType {
+			http.Error(w, "Content-Type must be "+NDJSONContentType, http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	var body io.Reader = r.Body
+	if strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
+		gReader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gReader.Close()
+
+		body = gReader
+	}
+
+	// HTTP/2 is always full duplex, the writers of it do not support that.
+	if err := enableFullDuplex(ctx); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", NDJSONContentType)
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+
+	req := make([]MakeShortsPostEndpointRequest, 0, streamChunkSize)
+	resp := make([]MakeShortsPostEndpointResponse, 0, streamChunkSize)
+
+	flush := func() bool {
+		if len(req) == 0 {
+			return true
+		}
+
+		err := shortenItems(ctx, stor, blocked, loops, req, resp)
+		if err == nil {
+			for _, item := range resp {
+				if err = encoder.Encode(item); err != nil {
+					return false
+				}
+			}
+		} else {
+			encoder.Encode(MakeShortsPostEndpointResponse{Status: BatchStatusError, Message: err.Error()})
+		}
+
+		w.Flush()
+
+		req, resp = req[:0], resp[:0]
+		return err == nil
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	var scanErr error
+	lines := scanLines(body, done, &scanErr)
+
+	ticker := time.NewTicker(streamFlushInterval)
+	defer ticker.Stop()
+
+	for isReading := true; isReading; {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				isReading = false
+				break
+			}
+
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+
+			item := MakeShortsPostEndpointRequest{}
+			itemResp := MakeShortsPostEndpointResponse{}
+			if err := json.Unmarshal(line, &item); err != nil {
+				itemResp.Status = BatchStatusInvalid
+				itemResp.Message = err.Error()
+			}
+
+			req = append(req, item)
+			resp = append(resp, itemResp)
+
+			if len(req) == streamChunkSize && !flush() {
+				return
+			}
+		case <-ticker.C:
+			if !flush() {
+				return
+			}
+		}
+	}
+
+	if !flush() {
+		return
+	}
+
+	if err := scanErr; err != nil {
+		encoder.Encode(MakeShortsPostEndpointResponse{Status: BatchStatusError, Message: err.Error()})
+		w.Flush()
+	}
+}
@@ -2,22 +2,55 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	handler "github.com/GermanVor/shortener-pet-project/cmd/shortener/handler"
+	"github.com/GermanVor/shortener-pet-project/internal/blocklist"
+	"github.com/GermanVor/shortener-pet-project/internal/clicks"
 	common "github.com/GermanVor/shortener-pet-project/internal/common"
+	"github.com/GermanVor/shortener-pet-project/internal/deletion"
+	"github.com/GermanVor/shortener-pet-project/internal/idgen"
+	"github.com/GermanVor/shortener-pet-project/internal/loopguard"
+	"github.com/GermanVor/shortener-pet-project/internal/migrations"
+	"github.com/GermanVor/shortener-pet-project/internal/preview"
+	"github.com/GermanVor/shortener-pet-project/internal/qr"
+	"github.com/GermanVor/shortener-pet-project/internal/session"
 	"github.com/GermanVor/shortener-pet-project/internal/storage"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
 )
 
 var Config = &common.Config{
 	ServerAddress:   "localhost:8080",
 	BaseURL:         "http://localhost:8080",
 	FileStoragePath: "",
+	RequestTimeout:  10 * time.Second,
+	IDStrategy:      idgen.StrategyBase62,
+	IDLength:        8,
+	IDAlphabet:      idgen.Base62Alphabet,
+	DedupeScope:     string(storage.DedupeGlobal),
+	SweepInterval:   time.Minute,
+	DeleteRetention: 30 * 24 * time.Hour,
+	SessionKeyPath:  "session.key",
 }
 
+// Time given to the requests in flight to finish on shutdown.
+const shutdownTimeout = 10 * time.Second
+
 func initConfig() {
 	common.InitFlagsConfig(Config)
 	flag.Parse()
@@ -26,38 +59,235 @@ func initConfig() {
 	log.Println("Config", Config)
 }
 
+func runMigrations() {
+	if Config.DatabaseDSN == "" {
+		log.Fatalln("Database address is required to run migrations")
+	}
+
+	dbContext := context.Background()
+	conn, err := pgxpool.Connect(dbContext, Config.DatabaseDSN)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer conn.Close()
+
+	migrationsList, err := migrations.Load()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	migrator := migrations.New(conn, migrationsList)
+
+	switch Config.Migrate {
+	case "up":
+		err = migrator.Up(dbContext)
+	case "down":
+		err = migrator.Down(dbContext, 1)
+	case "version":
+	default:
+		log.Fatalln("Unknown migrate command", Config.Migrate)
+	}
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	version, err := migrator.Version(dbContext)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	log.Println("Database schema version", version)
+}
+
+func initSessionCodec() (*session.Codec, error) {
+	keys := make([]string, 0)
+	for _, key := range strings.Split(Config.SessionKeys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		if Config.SessionKeyPath == "" {
+			return nil, errors.New("session keys or the session key file must be set")
+		}
+
+		key, err := loadSessionKey(Config.SessionKeyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return session.NewCodec(keys, Config.SessionEncrypt)
+}
+
+// loadSessionKey reads the session key of the file, the key is generated and
+// saved on the first start so the sessions survive the server restart.
+func loadSessionKey(path string) (string, error) {
+	keyBytes, err := os.ReadFile(path)
+	if err == nil {
+		if key := strings.TrimSpace(string(keyBytes)); key != "" {
+			return key, nil
+		}
+
+		return "", fmt.Errorf("session key file %s is empty", path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	keyBytes = make([]byte, 32)
+	if _, err = rand.Read(keyBytes); err != nil {
+		return "", err
+	}
+
+	key := hex.EncodeToString(keyBytes)
+	if err = os.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		return "", err
+	}
+
+	log.Println("Session keys are not set, the generated key is saved to", path)
+
+	return key, nil
+}
+
 func main() {
 	initConfig()
 
+	if Config.Migrate != "" {
+		runMigrations()
+		return
+	}
+
+	sessionCodec, err := initSessionCodec()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	router := gin.Default()
-	router.Use(handler.UseCookieMiddlware)
+	router.Use(handler.UseTimeoutMiddleware(Config.RequestTimeout))
+
+	idGen, err := idgen.New(Config.IDStrategy, Config.IDLength, Config.IDAlphabet, Config.IDSalt)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	dedupe, err := storage.ParseDedupeScope(Config.DedupeScope)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	var stor storage.Interface
 
 	if Config.DatabaseDSN != "" {
 		dbContext := context.Background()
-		storV2, err := storage.InitV2(Config.BaseURL, dbContext, Config.DatabaseDSN)
+		storV2, err := storage.InitV2(Config.BaseURL, dbContext, Config.DatabaseDSN, idGen, dedupe)
 		if err != nil {
 			log.Fatalln(err)
 		}
 
 		router.GET("ping", func(ctx *gin.Context) {
-			if storV2.Ping() == nil {
+			if storV2.Ping(ctx.Request.Context()) == nil {
 				ctx.Writer.WriteHeader(http.StatusOK)
 			}
 		})
 
 		stor = storV2
 	} else {
-		stor = storage.InitV1(Config.BaseURL, Config.FileStoragePath)
+		stor, err = storage.InitV1(Config.BaseURL, Config.FileStoragePath, idGen, dedupe)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if Config.ClickSalt == "" {
+		Config.ClickSalt = uuid.NewString()
+		log.Println("Click salt is not set, unique visitors are counted per server run")
 	}
 
-	handler.InitShortenerHandlers(router, stor)
+	router.Use(handler.UseCookieMiddlware(sessionCodec, stor))
+
+	// Background services outlive the server, so they finish the work
+	// accepted by the requests handled before the shutdown.
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	var background sync.WaitGroup
+
+	recorder := clicks.NewRecorder(stor, Config.ClickSalt, clicks.DefaultBufferSize, clicks.DefaultBatchSize, clicks.DefaultFlushInterval)
+	deletions := deletion.NewQueue(stor, deletion.DefaultWorkers, deletion.DefaultBufferSize, deletion.DefaultBatchSize, deletion.DefaultFlushInterval)
 
-	log.Println("Server started at", Config.ServerAddress)
+	background.Add(2)
+	go func() {
+		defer background.Done()
+		recorder.Run(backgroundCtx)
+	}()
+	go func() {
+		defer background.Done()
+		deletions.Run(backgroundCtx)
+	}()
 
-	err := router.Run(Config.ServerAddress)
+	blocked, err := blocklist.New(Config.BlocklistPath)
 	if err != nil {
-		log.Println("Server could not start", err)
+		log.Fatalln(err)
+	}
+
+	go blocked.Watch(backgroundCtx, blocklist.DefaultReloadInterval)
+
+	loops, err := loopguard.New(Config.BaseURL, strings.Split(Config.ShortenerDomains, ","))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	previews, err := preview.New(Config.PreviewTemplatesDir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	handler.InitShortenerHandlers(router, stor, handler.Options{
+		Clicks:     recorder,
+		Deletions:  deletions,
+		Blocklist:  blocked,
+		Loops:      loops,
+		QRCodes:    qr.NewCache(qr.DefaultCacheSize),
+		BaseURL:    Config.BaseURL,
+		Previews:   previews,
+		PreviewAll: Config.PreviewAll,
+		AdminToken: Config.AdminToken,
+	})
+
+	go storage.RunSweeper(backgroundCtx, stor, Config.SweepInterval, Config.DeleteRetention)
+
+	server := &http.Server{Addr: Config.ServerAddress, Handler: handler.WithResponseController(router)}
+
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	go func() {
+		log.Println("Server started at", Config.ServerAddress)
+
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println("Server could not start", err)
+			stopSignals()
+		}
+	}()
+
+	<-signalCtx.Done()
+	log.Println("Server is shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("Server could not shut down gracefully", err)
+	}
+
+	stopBackground()
+	background.Wait()
+
+	if closer, ok := stor.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Println("Storage could not be closed", err)
+		}
 	}
 }
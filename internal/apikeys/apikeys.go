@@ -0,0 +1,40 @@
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+const tokenPrefix = "sk_"
+
+// New generates an API key. The token is shown to the user once, only its
+// hash is stored.
+func New() (id, token string, err error) {
+	idBytes := make([]byte, 6)
+	if _, err = rand.Read(idBytes); err != nil {
+		return "", "", err
+	}
+
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return "", "", err
+	}
+
+	id = hex.EncodeToString(idBytes)
+	token = tokenPrefix + id + "_" + base64.RawURLEncoding.EncodeToString(secret)
+
+	return id, token, nil
+}
+
+// IsToken reports whether the value looks like a token made by New.
+func IsToken(value string) bool {
+	return strings.HasPrefix(value, tokenPrefix)
+}
+
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,434 @@
+package blocklist
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GermanVor/shortener-pet-project/internal/urlpolicy"
+	"golang.org/x/net/idna"
+)
+
+// DefaultReloadInterval is the interval the file is checked for changes.
+const DefaultReloadInterval = 5 * time.Second
+
+var ErrBlocked = errors.New("url is blocked")
+var ErrBadEntry = errors.New("blocklist entry is invalid")
+
+// List blocks the URLs by their domain or by a pattern. An entry without '/'
+// and '*' is a domain, it blocks the domain and its subdomains. The other
+// entries are patterns matched against the whole canonical URL ignoring
+// case, '*' matches any characters.
+//
+// The entries are loaded from a file having an entry per line, the empty
+// lines and the ones starting with '#' are skipped. Add and Remove edit the
+// file in place, so the comments and the order of the lines are kept. A nil
+// *List blocks nothing.
+type List struct {
+	path string
+	mux  sync.RWMutex
+
+	entries  []string
+	domains  map[string]bool
+	patterns []*regexp.Regexp
+
+	// modTime and size of the loaded file, the file is reloaded once they
+	// change.
+	modTime time.Time
+	size    int64
+}
+
+// New loads the list from the file, a missing file is an empty list created
+// on the first change. An empty path keeps the list in memory only.
+func New(path string) (*List, error) {
+	l := &List{path: path}
+	l.set(nil)
+
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// normalizeEntry lowercases the entry, the domains are converted to punycode
+// the same way urlpolicy does with the hosts.
+func normalizeEntry(entry string) (string, error) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if entry == "" {
+		return "", ErrBadEntry
+	}
+
+	if isPattern(entry) {
+		return entry, nil
+	}
+
+	domain, err := idna.Lookup.ToASCII(strings.TrimSuffix(entry, "."))
+	if err != nil || domain == "" {
+		return "", fmt.Errorf("%w: %s", ErrBadEntry, entry)
+	}
+
+	return domain, nil
+}
+
+func isPattern(entry string) bool {
+	return strings.ContainsAny(entry, "/*")
+}
+
+func compilePattern(pattern string) *regexp.Regexp {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+
+	return regexp.MustCompile("(?i)^" + strings.Join(parts, ".*") + "$")
+}
+
+// set replaces the entries, they must be normalized. It must be called with
+// mux locked.
+func (l *List) set(entries []string) {
+	unique := make(map[string]bool)
+	domains := make(map[string]bool)
+	patterns := make([]*regexp.Regexp, 0)
+
+	for _, entry := range entries {
+		if unique[entry] {
+			continue
+		}
+
+		unique[entry] = true
+
+		if isPattern(entry) {
+			patterns = append(patterns, compilePattern(entry))
+		} else {
+			domains[entry] = true
+		}
+	}
+
+	l.entries = make([]string, 0, len(unique))
+	for entry := range unique {
+		l.entries = append(l.entries, entry)
+	}
+
+	sort.Strings(l.entries)
+
+	l.domains, l.patterns = domains, patterns
+}
+
+// Blocked reports whether the URL is blocked.
+func (l *List) Blocked(rawURL string) bool {
+	if l == nil {
+		return false
+	}
+
+	canonicalURL := urlpolicy.Key(rawURL)
+
+	host := ""
+	if parsed, err := url.Parse(canonicalURL); err == nil {
+		host = strings.ToLower(parsed.Hostname())
+	}
+
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+
+	for host != "" {
+		if l.domains[host] {
+			return true
+		}
+
+		dot := strings.IndexByte(host, '.')
+		if dot == -1 {
+			break
+		}
+
+		host = host[dot+1:]
+	}
+
+	for _, pattern := range l.patterns {
+		if pattern.MatchString(canonicalURL) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Entries returns the sorted entries of the list.
+func (l *List) Entries() []string {
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+
+	return append([]string{}, l.entries...)
+}
+
+// Add appends the entries to the end of the file, the entries already in the
+// list are skipped.
+func (l *List) Add(entries ...string) error {
+	normalized, err := normalizeEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	return l.update(func(lines []string) []string {
+		present := make(map[string]bool)
+		for _, line := range lines {
+			if entry, ok := lineEntry(line); ok {
+				present[entry] = true
+			}
+		}
+
+		for _, entry := range normalized {
+			if !present[entry] {
+				present[entry] = true
+				lines = append(lines, entry)
+			}
+		}
+
+		return lines
+	})
+}
+
+// Remove removes the lines of the entries from the file, the unknown entries
+// are skipped.
+func (l *List) Remove(entries ...string) error {
+	normalized, err := normalizeEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	removed := make(map[string]bool)
+	for _, entry := range normalized {
+		removed[entry] = true
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	return l.update(func(lines []string) []string {
+		kept := make([]string, 0, len(lines))
+		for _, line := range lines {
+			if entry, ok := lineEntry(line); !ok || !removed[entry] {
+				kept = append(kept, line)
+			}
+		}
+
+		return kept
+	})
+}
+
+func normalizeEntries(entries []string) ([]string, error) {
+	res := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		normalized, err := normalizeEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, normalized)
+	}
+
+	return res, nil
+}
+
+// lineEntry returns the normalized entry of the line, false for the empty
+// lines, the comments and the invalid entries.
+func lineEntry(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", false
+	}
+
+	entry, err := normalizeEntry(line)
+	return entry, err == nil
+}
+
+// parseLines returns the entries of the file lines.
+func parseLines(lines []string) ([]string, error) {
+	entries := make([]string, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entry, err := normalizeEntry(line)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// readLines returns the lines of the file, the entries when the list is kept
+// in memory only. It must be called with mux locked.
+func (l *List) readLines() ([]string, error) {
+	if l.path == "" {
+		return append([]string{}, l.entries...), nil
+	}
+
+	content, err := os.ReadFile(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return splitLines(content), nil
+}
+
+func splitLines(content []byte) []string {
+	text := strings.TrimSuffix(string(content), "\n")
+	if text == "" {
+		return nil
+	}
+
+	return strings.Split(text, "\n")
+}
+
+// update edits the current lines of the file, saves them and makes their
+// entries current. The file having an invalid entry is not changed. It must be
+// called with mux locked.
+func (l *List) update(edit func(lines []string) []string) error {
+	lines, err := l.readLines()
+	if err != nil {
+		return err
+	}
+
+	lines = edit(lines)
+
+	entries, err := parseLines(lines)
+	if err != nil {
+		return err
+	}
+
+	if err = l.save(lines); err != nil {
+		return err
+	}
+
+	l.set(entries)
+
+	return nil
+}
+
+// save writes the lines to the file replacing it atomically, it must be called
+// with mux locked.
+func (l *List) save(lines []string) error {
+	if l.path == "" {
+		return nil
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmpFile.Name())
+
+	writer := bufio.NewWriter(tmpFile)
+	for _, line := range lines {
+		writer.WriteString(line + "\n")
+	}
+
+	if err = writer.Flush(); err == nil {
+		err = tmpFile.Sync()
+	}
+
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpFile.Name(), l.path); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(l.path); err == nil {
+		l.modTime, l.size = info.ModTime(), info.Size()
+	}
+
+	return nil
+}
+
+// Reload reads the file if it changed since it was loaded. The list is kept
+// as it is when the file has an invalid entry.
+func (l *List) Reload() error {
+	if l.path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	l.mux.RLock()
+	changed := !info.ModTime().Equal(l.modTime) || info.Size() != l.size
+	l.mux.RUnlock()
+
+	if !changed {
+		return nil
+	}
+
+	content, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+
+	entries, err := parseLines(splitLines(content))
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	// The broken file is not read again until it is changed.
+	l.modTime, l.size = info.ModTime(), info.Size()
+	if err != nil {
+		return err
+	}
+
+	l.set(entries)
+
+	return nil
+}
+
+// Watch reloads the list once the file changes until ctx is done.
+func (l *List) Watch(ctx context.Context, interval time.Duration) {
+	if l.path == "" || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.Reload(); err != nil {
+				log.Println("Blocklist could not be reloaded", l.path, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package blocklist_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GermanVor/shortener-pet-project/internal/blocklist"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlocked(t *testing.T) {
+	list, err := blocklist.New("")
+	require.NoError(t, err)
+
+	require.NoError(t, list.Add("Phishing.biz", "пример.рф", "*/login?redirect=*", "http://oknetcumk.biz/promo/*"))
+	require.ErrorIs(t, list.Add("bad domain"), blocklist.ErrBadEntry)
+	require.ErrorIs(t, list.Add(""), blocklist.ErrBadEntry)
+
+	blocked := []string{
+		"http://phishing.biz/",
+		"https://login.phishing.biz/bank",
+		"HTTP://PHISHING.BIZ.:80/",
+		"http://пример.рф/",
+		"http://www.xn--e1afmkfd.xn--p1ai/",
+		"https://oknetcumk.biz/login?redirect=http://phishing.biz",
+		"http://oknetcumk.biz/PROMO/1",
+	}
+
+	for _, rawURL := range blocked {
+		require.True(t, list.Blocked(rawURL), rawURL)
+	}
+
+	allowed := []string{
+		"http://notphishing.biz/",
+		"http://phishing.biz.oknetcumk.biz/",
+		"http://oknetcumk.biz/promo",
+		"http://oknetcumk.biz/login",
+	}
+
+	for _, rawURL := range allowed {
+		require.False(t, list.Blocked(rawURL), rawURL)
+	}
+
+	require.Equal(t, []string{
+		"*/login?redirect=*",
+		"http://oknetcumk.biz/promo/*",
+		"phishing.biz",
+		"xn--e1afmkfd.xn--p1ai",
+	}, list.Entries())
+
+	require.NoError(t, list.Remove("PHISHING.biz", "unknown.biz"))
+	require.False(t, list.Blocked("http://phishing.biz/"))
+
+	var nilList *blocklist.List
+	require.False(t, nilList.Blocked("http://phishing.biz/"))
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+
+	list, err := blocklist.New(path)
+	require.NoError(t, err)
+	require.Empty(t, list.Entries())
+
+	require.NoError(t, list.Add("phishing.biz"))
+
+	loaded, err := blocklist.New(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"phishing.biz"}, loaded.Entries())
+
+	content := "# phishing\nphishing.biz\n\nmalware.biz\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+
+	// The modification time may be unchanged on the coarse file systems.
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(path, later, later))
+
+	require.NoError(t, list.Reload())
+	require.True(t, list.Blocked("http://malware.biz/"))
+	require.Equal(t, []string{"malware.biz", "phishing.biz"}, list.Entries())
+
+	require.NoError(t, os.WriteFile(path, []byte("malware.biz\nbad domain\n"), 0644))
+	later = later.Add(time.Second)
+	require.NoError(t, os.Chtimes(path, later, later))
+
+	require.ErrorIs(t, list.Reload(), blocklist.ErrBadEntry)
+	require.True(t, list.Blocked("http://phishing.biz/"))
+}
+
+func TestEditKeepsComments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+
+	content := "# phishing\nphishing.biz\n\n# malware, reported 2022-10-06\nMalware.biz\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+
+	list, err := blocklist.New(path)
+	require.NoError(t, err)
+
+	require.NoError(t, list.Add("spam.biz", "phishing.biz"))
+	require.NoError(t, list.Remove("malware.biz"))
+	require.Equal(t, []string{"phishing.biz", "spam.biz"}, list.Entries())
+
+	saved, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "# phishing\nphishing.biz\n\n# malware, reported 2022-10-06\nspam.biz\n", string(saved))
+
+	// The file changed by hand is edited as it is now.
+	require.NoError(t, os.WriteFile(path, []byte("# by hand\nmalware.biz\n"), 0644))
+	require.NoError(t, list.Add("spam.biz"))
+	require.Equal(t, []string{"malware.biz", "spam.biz"}, list.Entries())
+
+	require.NoError(t, os.WriteFile(path, []byte("bad domain\n"), 0644))
+	require.ErrorIs(t, list.Add("spam.biz"), blocklist.ErrBadEntry)
+	require.Equal(t, []string{"malware.biz", "spam.biz"}, list.Entries())
+}
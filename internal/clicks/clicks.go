@@ -0,0 +1,127 @@
+package clicks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/GermanVor/shortener-pet-project/internal/storage"
+)
+
+const (
+	DefaultBufferSize    = 4096
+	DefaultBatchSize     = 256
+	DefaultFlushInterval = time.Second
+)
+
+type Store interface {
+	RecordClicks(ctx context.Context, clicks []storage.Click) error
+}
+
+// Recorder saves clicks to the store in batches from a background goroutine,
+// so recording never blocks the redirect. When the buffer is full clicks are
+// dropped. A nil *Recorder records nothing.
+type Recorder struct {
+	// dropped is accessed atomically, so it goes first to be 64-bit aligned.
+	dropped int64
+
+	store         Store
+	ipSalt        string
+	clicks        chan storage.Click
+	batchSize     int
+	flushInterval time.Duration
+}
+
+func NewRecorder(store Store, ipSalt string, bufferSize, batchSize int, flushInterval time.Duration) *Recorder {
+	return &Recorder{
+		store:         store,
+		ipSalt:        ipSalt,
+		clicks:        make(chan storage.Click, bufferSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+	}
+}
+
+// Record queues a redirect to shortURLId, the client ip is stored hashed.
+func (r *Recorder) Record(shortURLId, referrer, userAgent, ip string) {
+	if r == nil {
+		return
+	}
+
+	click := storage.Click{
+		ShortURLId: shortURLId,
+		Time:       time.Now(),
+		Referrer:   referrer,
+		UserAgent:  userAgent,
+		IPHash:     HashIP(r.ipSalt, ip),
+	}
+
+	select {
+	case r.clicks <- click:
+	default:
+		atomic.AddInt64(&r.dropped, 1)
+	}
+}
+
+// Dropped returns the amount of clicks lost because of the full buffer.
+func (r *Recorder) Dropped() int64 {
+	return atomic.LoadInt64(&r.dropped)
+}
+
+// flush saves the batch. It is not bound to the Run context, so the clicks
+// are saved even while shutting down.
+func (r *Recorder) flush(batch []storage.Click) []storage.Click {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	if err := r.store.RecordClicks(context.Background(), batch); err != nil {
+		log.Println("Clicks could not be recorded", len(batch), err)
+	}
+
+	return batch[:0]
+}
+
+// Run saves the recorded clicks until ctx is done, then it saves the clicks
+// left in the buffer and returns.
+func (r *Recorder) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]storage.Click, 0, r.batchSize)
+
+	for {
+		select {
+		case click := <-r.clicks:
+			batch = append(batch, click)
+			if len(batch) >= r.batchSize {
+				batch = r.flush(batch)
+			}
+		case <-ticker.C:
+			batch = r.flush(batch)
+		case <-ctx.Done():
+			for {
+				select {
+				case click := <-r.clicks:
+					batch = append(batch, click)
+					if len(batch) >= r.batchSize {
+						batch = r.flush(batch)
+					}
+				default:
+					r.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// HashIP hides the client address keeping it usable for counting unique
+// visitors.
+func HashIP(salt, ip string) string {
+	sum := sha256.Sum256([]byte(salt + ip))
+	return hex.EncodeToString(sum[:16])
+}
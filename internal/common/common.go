@@ -2,7 +2,11 @@ package common
 
 import (
 	"flag"
+	"fmt"
+	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -13,6 +17,74 @@ type Config struct {
 	FileStoragePath string
 
 	DatabaseDSN string
+
+	// RequestTimeout bounds the storage calls of a request, zero disables it.
+	RequestTimeout time.Duration
+
+	IDStrategy string
+	IDLength   int
+	IDAlphabet string
+	IDSalt     string
+
+	// DedupeScope tells which links are reused for an already shortened URL:
+	// global, user or none.
+	DedupeScope string
+
+	SweepInterval time.Duration
+	// DeleteRetention is the time the deleted links can be restored before
+	// they are purged, zero keeps them forever.
+	DeleteRetention time.Duration
+
+	ClickSalt string
+
+	// SessionKeys is a comma separated list of the session cookies keys, the
+	// first one signs new cookies.
+	SessionKeys    string
+	SessionEncrypt bool
+	// SessionKeyPath keeps the generated session key when SessionKeys are not
+	// set, without both the server does not start.
+	SessionKeyPath string
+
+	// BlocklistPath is the file of the blocked domains and URL patterns, it is
+	// reloaded once changed.
+	BlocklistPath string
+	// ShortenerDomains is a comma separated list of the other shorteners
+	// domains, their links are not shortened.
+	ShortenerDomains string
+
+	// AdminToken authorizes the admin API, it is disabled when empty.
+	AdminToken string
+
+	// PreviewAll shows the preview page of every link instead of redirecting.
+	PreviewAll bool
+	// PreviewTemplatesDir holds the *.html templates overriding the embedded
+	// preview ones.
+	PreviewTemplatesDir string
+
+	Migrate string
+}
+
+// redacted replaces the set secret with a mask.
+func redacted(secret string) string {
+	if secret == "" {
+		return ""
+	}
+
+	return "***"
+}
+
+// String masks the secrets, so the config can be logged.
+func (c Config) String() string {
+	// The plain type has no String method to call back.
+	type plainConfig Config
+
+	masked := plainConfig(c)
+	masked.IDSalt = redacted(masked.IDSalt)
+	masked.ClickSalt = redacted(masked.ClickSalt)
+	masked.SessionKeys = redacted(masked.SessionKeys)
+	masked.AdminToken = redacted(masked.AdminToken)
+
+	return fmt.Sprintf("%+v", masked)
 }
 
 func InitEnvConfig(config *Config) *Config {
@@ -34,6 +106,98 @@ func InitEnvConfig(config *Config) *Config {
 		config.DatabaseDSN = datavaseDSN
 	}
 
+	if requestTimeoutStr, ok := os.LookupEnv("REQUEST_TIMEOUT"); ok {
+		if requestTimeout, err := time.ParseDuration(requestTimeoutStr); err == nil {
+			config.RequestTimeout = requestTimeout
+		} else {
+			log.Println("Bad REQUEST_TIMEOUT", err)
+		}
+	}
+
+	if idStrategy, ok := os.LookupEnv("ID_STRATEGY"); ok {
+		config.IDStrategy = idStrategy
+	}
+
+	if idLengthStr, ok := os.LookupEnv("ID_LENGTH"); ok {
+		if idLength, err := strconv.Atoi(idLengthStr); err == nil {
+			config.IDLength = idLength
+		} else {
+			log.Println("Bad ID_LENGTH", err)
+		}
+	}
+
+	if idAlphabet, ok := os.LookupEnv("ID_ALPHABET"); ok {
+		config.IDAlphabet = idAlphabet
+	}
+
+	if idSalt, ok := os.LookupEnv("ID_SALT"); ok {
+		config.IDSalt = idSalt
+	}
+
+	if dedupeScope, ok := os.LookupEnv("DEDUPE_SCOPE"); ok {
+		config.DedupeScope = dedupeScope
+	}
+
+	if clickSalt, ok := os.LookupEnv("CLICK_SALT"); ok {
+		config.ClickSalt = clickSalt
+	}
+
+	if sessionKeys, ok := os.LookupEnv("SESSION_KEYS"); ok {
+		config.SessionKeys = sessionKeys
+	}
+
+	if sessionKeyPath, ok := os.LookupEnv("SESSION_KEY_FILE"); ok {
+		config.SessionKeyPath = sessionKeyPath
+	}
+
+	if sessionEncryptStr, ok := os.LookupEnv("SESSION_ENCRYPT"); ok {
+		if sessionEncrypt, err := strconv.ParseBool(sessionEncryptStr); err == nil {
+			config.SessionEncrypt = sessionEncrypt
+		} else {
+			log.Println("Bad SESSION_ENCRYPT", err)
+		}
+	}
+
+	if sweepIntervalStr, ok := os.LookupEnv("SWEEP_INTERVAL"); ok {
+		if sweepInterval, err := time.ParseDuration(sweepIntervalStr); err == nil {
+			config.SweepInterval = sweepInterval
+		} else {
+			log.Println("Bad SWEEP_INTERVAL", err)
+		}
+	}
+
+	if deleteRetentionStr, ok := os.LookupEnv("DELETE_RETENTION"); ok {
+		if deleteRetention, err := time.ParseDuration(deleteRetentionStr); err == nil {
+			config.DeleteRetention = deleteRetention
+		} else {
+			log.Println("Bad DELETE_RETENTION", err)
+		}
+	}
+
+	if blocklistPath, ok := os.LookupEnv("BLOCKLIST_FILE"); ok {
+		config.BlocklistPath = blocklistPath
+	}
+
+	if shortenerDomains, ok := os.LookupEnv("SHORTENER_DOMAINS"); ok {
+		config.ShortenerDomains = shortenerDomains
+	}
+
+	if adminToken, ok := os.LookupEnv("ADMIN_TOKEN"); ok {
+		config.AdminToken = adminToken
+	}
+
+	if previewAllStr, ok := os.LookupEnv("PREVIEW_ALL"); ok {
+		if previewAll, err := strconv.ParseBool(previewAllStr); err == nil {
+			config.PreviewAll = previewAll
+		} else {
+			log.Println("Bad PREVIEW_ALL", err)
+		}
+	}
+
+	if previewTemplatesDir, ok := os.LookupEnv("PREVIEW_TEMPLATES_DIR"); ok {
+		config.PreviewTemplatesDir = previewTemplatesDir
+	}
+
 	return config
 }
 
@@ -42,6 +206,34 @@ const (
 	bUsage = "Base URL"
 	fUsage = "Storage file path"
 	dUsage = "Database address to connect"
+
+	requestTimeoutUsage = "Request timeout, 0 disables it"
+
+	idStrategyUsage = "Short URL id generator: base62, hashid or ulid"
+	idLengthUsage   = "Short URL id length (minimal one for hashid)"
+	idAlphabetUsage = "Short URL id alphabet"
+	idSaltUsage     = "Salt of the hashid generator, required by it"
+
+	dedupeScopeUsage = "Links reused for an already shortened URL: global, user or none"
+
+	sweepIntervalUsage   = "Interval of purging expired links"
+	deleteRetentionUsage = "Time the deleted links can be restored before they are purged, 0 keeps them forever"
+
+	clickSaltUsage = "Salt of the clients addresses hashes"
+
+	sessionKeysUsage    = "Comma separated session cookie keys, the first one signs new cookies"
+	sessionEncryptUsage = "Encrypt session cookies"
+	sessionKeyPathUsage = "File of the session key generated when the session keys are not set"
+
+	blocklistPathUsage = "File of the blocked domains and URL patterns"
+	adminTokenUsage    = "Token of the admin API, empty disables it"
+
+	shortenerDomainsUsage = "Comma separated domains of the other shorteners, their links are not shortened"
+
+	previewAllUsage          = "Show the preview page of every link instead of redirecting"
+	previewTemplatesDirUsage = "Directory of the templates overriding the embedded preview ones"
+
+	migrateUsage = "Run database migrations and exit: up, down (rolls back one) or version"
 )
 
 func InitFlagsConfig(config *Config) *Config {
@@ -49,6 +241,24 @@ func InitFlagsConfig(config *Config) *Config {
 	flag.StringVar(&config.BaseURL, "b", config.BaseURL, bUsage)
 	flag.StringVar(&config.FileStoragePath, "f", config.FileStoragePath, fUsage)
 	flag.StringVar(&config.DatabaseDSN, "d", config.DatabaseDSN, dUsage)
+	flag.DurationVar(&config.RequestTimeout, "request-timeout", config.RequestTimeout, requestTimeoutUsage)
+	flag.StringVar(&config.IDStrategy, "id-strategy", config.IDStrategy, idStrategyUsage)
+	flag.IntVar(&config.IDLength, "id-length", config.IDLength, idLengthUsage)
+	flag.StringVar(&config.IDAlphabet, "id-alphabet", config.IDAlphabet, idAlphabetUsage)
+	flag.StringVar(&config.IDSalt, "id-salt", config.IDSalt, idSaltUsage)
+	flag.StringVar(&config.DedupeScope, "dedupe-scope", config.DedupeScope, dedupeScopeUsage)
+	flag.DurationVar(&config.SweepInterval, "sweep-interval", config.SweepInterval, sweepIntervalUsage)
+	flag.DurationVar(&config.DeleteRetention, "delete-retention", config.DeleteRetention, deleteRetentionUsage)
+	flag.StringVar(&config.ClickSalt, "click-salt", config.ClickSalt, clickSaltUsage)
+	flag.StringVar(&config.SessionKeys, "session-keys", config.SessionKeys, sessionKeysUsage)
+	flag.BoolVar(&config.SessionEncrypt, "session-encrypt", config.SessionEncrypt, sessionEncryptUsage)
+	flag.StringVar(&config.SessionKeyPath, "session-key-file", config.SessionKeyPath, sessionKeyPathUsage)
+	flag.StringVar(&config.BlocklistPath, "blocklist-file", config.BlocklistPath, blocklistPathUsage)
+	flag.StringVar(&config.ShortenerDomains, "shortener-domains", config.ShortenerDomains, shortenerDomainsUsage)
+	flag.StringVar(&config.AdminToken, "admin-token", config.AdminToken, adminTokenUsage)
+	flag.BoolVar(&config.PreviewAll, "preview-all", config.PreviewAll, previewAllUsage)
+	flag.StringVar(&config.PreviewTemplatesDir, "preview-templates-dir", config.PreviewTemplatesDir, previewTemplatesDirUsage)
+	flag.StringVar(&config.Migrate, "migrate", config.Migrate, migrateUsage)
 
 	return config
 }
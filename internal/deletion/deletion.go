@@ -0,0 +1,256 @@
+package deletion
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultWorkers       = 4
+	DefaultBufferSize    = 1024
+	DefaultBatchSize     = 256
+	DefaultFlushInterval = time.Second
+)
+
+type Store interface {
+	DeleteKeys(ctx context.Context, items []string, userUUID string) error
+}
+
+type job struct {
+	userUUID string
+	ids      []string
+}
+
+// Metrics are the counters of the queue, the ids are counted.
+type Metrics struct {
+	Depth    int   `json:"depth"`
+	Enqueued int64 `json:"enqueued"`
+	Deleted  int64 `json:"deleted"`
+	Failed   int64 `json:"failed"`
+	Canceled int64 `json:"canceled"`
+}
+
+// Queue deletes the users links in the background. A pool of workers takes
+// the jobs from the shared buffer and merges the ids of every user into one
+// DeleteKeys call per batch.
+type Queue struct {
+	// The counters are accessed atomically, so they go first to be 64-bit
+	// aligned.
+	enqueued int64
+	deleted  int64
+	failed   int64
+	canceled int64
+
+	// pending counts the enqueued and not yet flushed ids by user,
+	// cancellations counts the ones of them to skip.
+	pending       map[string]map[string]int
+	cancellations map[string]map[string]int
+	mux           sync.Mutex
+	// inFlight is held by the workers while deleting, so Cancel waits for the
+	// deletions it is too late to skip.
+	inFlight sync.RWMutex
+
+	store         Store
+	jobs          chan job
+	workers       int
+	batchSize     int
+	flushInterval time.Duration
+}
+
+func NewQueue(store Store, workers, bufferSize, batchSize int, flushInterval time.Duration) *Queue {
+	return &Queue{
+		pending:       make(map[string]map[string]int),
+		cancellations: make(map[string]map[string]int),
+		store:         store,
+		jobs:          make(chan job, bufferSize),
+		workers:       workers,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+	}
+}
+
+// Enqueue schedules the deletion of the user links. It waits while the buffer
+// is full until ctx is done.
+func (q *Queue) Enqueue(ctx context.Context, userUUID string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// The ids are pending before a worker can take them.
+	q.mux.Lock()
+	for _, id := range ids {
+		addCount(q.pending, userUUID, id, 1)
+	}
+	q.mux.Unlock()
+
+	select {
+	case q.jobs <- job{userUUID: userUUID, ids: ids}:
+		atomic.AddInt64(&q.enqueued, int64(len(ids)))
+		return nil
+	case <-ctx.Done():
+		q.take(userUUID, ids)
+		return ctx.Err()
+	}
+}
+
+// Cancel drops the pending deletions of the user links, so they are not
+// deleted after being restored. The ids enqueued later are deleted as usual.
+// It returns the ids which deletions are canceled.
+func (q *Queue) Cancel(userUUID string, ids []string) []string {
+	q.inFlight.Lock()
+	defer q.inFlight.Unlock()
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	res := make([]string, 0)
+	for _, id := range ids {
+		pending := q.pending[userUUID][id] - q.cancellations[userUUID][id]
+		if pending > 0 {
+			addCount(q.cancellations, userUUID, id, pending)
+			res = append(res, id)
+		}
+	}
+
+	return res
+}
+
+// take marks the ids as no longer pending and returns the ones which
+// deletions are not canceled.
+func (q *Queue) take(userUUID string, ids []string) []string {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	res := make([]string, 0, len(ids))
+	for _, id := range ids {
+		addCount(q.pending, userUUID, id, -1)
+
+		if q.cancellations[userUUID][id] > 0 {
+			addCount(q.cancellations, userUUID, id, -1)
+		} else {
+			res = append(res, id)
+		}
+	}
+
+	return res
+}
+
+// addCount changes the count of the user id dropping the zero ones.
+func addCount(counts map[string]map[string]int, userUUID, id string, delta int) {
+	if counts[userUUID] == nil {
+		counts[userUUID] = make(map[string]int)
+	}
+
+	counts[userUUID][id] += delta
+	if counts[userUUID][id] <= 0 {
+		delete(counts[userUUID], id)
+	}
+
+	if len(counts[userUUID]) == 0 {
+		delete(counts, userUUID)
+	}
+}
+
+func (q *Queue) Metrics() Metrics {
+	return Metrics{
+		Depth:    len(q.jobs),
+		Enqueued: atomic.LoadInt64(&q.enqueued),
+		Deleted:  atomic.LoadInt64(&q.deleted),
+		Failed:   atomic.LoadInt64(&q.failed),
+		Canceled: atomic.LoadInt64(&q.canceled),
+	}
+}
+
+// Run deletes the enqueued links until ctx is done, then it deletes the links
+// left in the buffer and returns once all the workers are finished.
+func (q *Queue) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for i := 0; i < q.workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// batch holds the ids to delete by user.
+type batch struct {
+	ids  map[string][]string
+	size int
+}
+
+func (b *batch) add(j job) {
+	b.ids[j.userUUID] = append(b.ids[j.userUUID], j.ids...)
+	b.size += len(j.ids)
+}
+
+// flush deletes the batch. It is not bound to the Run context, so the links
+// are deleted even while shutting down.
+func (q *Queue) flush(b *batch) {
+	for userUUID, ids := range b.ids {
+		delete(b.ids, userUUID)
+		q.delete(userUUID, ids)
+	}
+
+	b.size = 0
+}
+
+// delete deletes the user links which deletions are not canceled.
+func (q *Queue) delete(userUUID string, ids []string) {
+	q.inFlight.RLock()
+	defer q.inFlight.RUnlock()
+
+	kept := q.take(userUUID, ids)
+	atomic.AddInt64(&q.canceled, int64(len(ids)-len(kept)))
+
+	if len(kept) == 0 {
+		return
+	}
+
+	if err := q.store.DeleteKeys(context.Background(), kept, userUUID); err != nil {
+		log.Println("Links could not be deleted", userUUID, len(kept), err)
+		atomic.AddInt64(&q.failed, int64(len(kept)))
+	} else {
+		atomic.AddInt64(&q.deleted, int64(len(kept)))
+	}
+}
+
+func (q *Queue) work(ctx context.Context) {
+	ticker := time.NewTicker(q.flushInterval)
+	defer ticker.Stop()
+
+	b := &batch{ids: make(map[string][]string)}
+
+	for {
+		select {
+		case j := <-q.jobs:
+			b.add(j)
+			if b.size >= q.batchSize {
+				q.flush(b)
+			}
+		case <-ticker.C:
+			q.flush(b)
+		case <-ctx.Done():
+			for {
+				select {
+				case j := <-q.jobs:
+					b.add(j)
+					if b.size >= q.batchSize {
+						q.flush(b)
+					}
+				default:
+					q.flush(b)
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package deletion_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GermanVor/shortener-pet-project/internal/deletion"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeStore struct {
+	mux   sync.Mutex
+	calls int
+	ids   map[string][]string
+}
+
+func (s *fakeStore) DeleteKeys(ctx context.Context, items []string, userUUID string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.calls++
+	s.ids[userUUID] = append(s.ids[userUUID], items...)
+
+	return nil
+}
+
+func TestQueueDrainsOnShutdown(t *testing.T) {
+	store := &fakeStore{ids: make(map[string][]string)}
+	queue := deletion.NewQueue(store, 2, 16, 100, time.Hour)
+
+	ctx := context.Background()
+	require.NoError(t, queue.Enqueue(ctx, "user_a", []string{"1", "2"}))
+	require.NoError(t, queue.Enqueue(ctx, "user_a", []string{"3"}))
+	require.NoError(t, queue.Enqueue(ctx, "user_b", []string{"4"}))
+	require.Equal(t, 3, queue.Metrics().Depth)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	queue.Run(runCtx)
+
+	require.ElementsMatch(t, []string{"1", "2", "3"}, store.ids["user_a"])
+	require.ElementsMatch(t, []string{"4"}, store.ids["user_b"])
+
+	metrics := queue.Metrics()
+	require.Equal(t, 0, metrics.Depth)
+	require.Equal(t, int64(4), metrics.Enqueued)
+	require.Equal(t, int64(4), metrics.Deleted)
+	require.Equal(t, int64(0), metrics.Failed)
+
+	full := deletion.NewQueue(store, 1, 0, 100, time.Hour)
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, full.Enqueue(timeoutCtx, "user_a", []string{"5"}), context.DeadlineExceeded)
+}
+
+func TestQueueCancel(t *testing.T) {
+	store := &fakeStore{ids: make(map[string][]string)}
+	queue := deletion.NewQueue(store, 1, 16, 100, time.Hour)
+
+	ctx := context.Background()
+	require.NoError(t, queue.Enqueue(ctx, "user_a", []string{"1", "2"}))
+	require.NoError(t, queue.Enqueue(ctx, "user_b", []string{"1"}))
+
+	require.Equal(t, []string{"1"}, queue.Cancel("user_a", []string{"1", "3"}))
+	require.Empty(t, queue.Cancel("user_a", []string{"1"}))
+
+	require.NoError(t, queue.Enqueue(ctx, "user_a", []string{"1"}))
+
+	runCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	queue.Run(runCtx)
+
+	require.ElementsMatch(t, []string{"1", "2"}, store.ids["user_a"])
+	require.ElementsMatch(t, []string{"1"}, store.ids["user_b"])
+
+	metrics := queue.Metrics()
+	require.Equal(t, int64(4), metrics.Enqueued)
+	require.Equal(t, int64(3), metrics.Deleted)
+	require.Equal(t, int64(1), metrics.Canceled)
+}
@@ -0,0 +1,163 @@
+package idgen
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	hashIDMinAlphabetLength = 16
+	hashIDSepDiv            = 3.5
+	hashIDGuardDiv          = 12
+	hashIDSeps              = "cfhistuCFHISTU"
+)
+
+// HashID encodes the storage sequence with the Hashids algorithm, so IDs are
+// unique and salted but still short.
+type HashID struct {
+	minLength int
+	alphabet  []byte
+	seps      []byte
+	guards    []byte
+	salt      []byte
+}
+
+func NewHashID(minLength int, alphabet, salt string) (*HashID, error) {
+	if minLength < 0 {
+		return nil, ErrBadLength
+	}
+
+	chars, err := uniqueAlphabet(alphabet)
+	if err != nil {
+		return nil, err
+	}
+	if len(chars) < hashIDMinAlphabetLength {
+		return nil, fmt.Errorf("%w: at least %d characters are required", ErrBadAlphabet, hashIDMinAlphabetLength)
+	}
+
+	// Without the salt the alphabet is not shuffled and the IDs are a public
+	// encoding of the sequence anyone can enumerate.
+	if salt == "" {
+		return nil, ErrMissingSalt
+	}
+
+	g := &HashID{minLength: minLength, salt: []byte(salt)}
+
+	for _, c := range chars {
+		if strings.IndexByte(hashIDSeps, c) >= 0 {
+			g.seps = append(g.seps, c)
+		} else {
+			g.alphabet = append(g.alphabet, c)
+		}
+	}
+
+	shuffle(g.seps, g.salt)
+
+	if len(g.seps) == 0 || float64(len(g.alphabet))/float64(len(g.seps)) > hashIDSepDiv {
+		sepsLength := ceilDiv(float64(len(g.alphabet)), hashIDSepDiv)
+		if sepsLength == 1 {
+			sepsLength++
+		}
+
+		if sepsLength > len(g.seps) {
+			diff := sepsLength - len(g.seps)
+			g.seps = append(g.seps, g.alphabet[:diff]...)
+			g.alphabet = g.alphabet[diff:]
+		} else {
+			g.seps = g.seps[:sepsLength]
+		}
+	}
+
+	shuffle(g.alphabet, g.salt)
+
+	guardCount := ceilDiv(float64(len(g.alphabet)), hashIDGuardDiv)
+	if len(g.alphabet) < 3 {
+		g.guards = g.seps[:guardCount]
+		g.seps = g.seps[guardCount:]
+	} else {
+		g.guards = g.alphabet[:guardCount]
+		g.alphabet = g.alphabet[guardCount:]
+	}
+
+	return g, nil
+}
+
+func (g *HashID) Generate(seq uint64) (string, error) {
+	alphabet := append([]byte(nil), g.alphabet...)
+
+	numberHash := seq % 100
+	lottery := alphabet[numberHash%uint64(len(alphabet))]
+
+	buffer := append([]byte{lottery}, g.salt...)
+	buffer = append(buffer, alphabet...)
+	shuffle(alphabet, buffer[:len(alphabet)])
+
+	res := append([]byte{lottery}, toAlphabet(seq, alphabet)...)
+
+	if len(res) < g.minLength {
+		guardIndex := (numberHash + uint64(res[0])) % uint64(len(g.guards))
+		res = append([]byte{g.guards[guardIndex]}, res...)
+
+		if len(res) < g.minLength {
+			guardIndex = (numberHash + uint64(res[2])) % uint64(len(g.guards))
+			res = append(res, g.guards[guardIndex])
+		}
+	}
+
+	halfLength := len(alphabet) / 2
+	for len(res) < g.minLength {
+		shuffle(alphabet, append([]byte(nil), alphabet...))
+
+		padded := append([]byte(nil), alphabet[halfLength:]...)
+		padded = append(padded, res...)
+		padded = append(padded, alphabet[:halfLength]...)
+
+		if excess := len(padded) - g.minLength; excess > 0 {
+			padded = padded[excess/2 : excess/2+g.minLength]
+		}
+
+		res = padded
+	}
+
+	return string(res), nil
+}
+
+func ceilDiv(a, b float64) int {
+	res := int(a / b)
+	if float64(res)*b < a {
+		res++
+	}
+
+	return res
+}
+
+func toAlphabet(n uint64, alphabet []byte) []byte {
+	res := make([]byte, 0, 12)
+	base := uint64(len(alphabet))
+
+	for {
+		res = append([]byte{alphabet[n%base]}, res...)
+		n /= base
+
+		if n == 0 {
+			return res
+		}
+	}
+}
+
+// shuffle is the Hashids consistent shuffle, it permutes alphabet in place
+// depending on salt only.
+func shuffle(alphabet, salt []byte) {
+	if len(salt) == 0 {
+		return
+	}
+
+	for i, v, p := len(alphabet)-1, 0, 0; i > 0; i, v = i-1, v+1 {
+		v %= len(salt)
+		integer := int(salt[v])
+		p += integer
+		j := (integer + v + p) % i
+
+		alphabet[i], alphabet[j] = alphabet[j], alphabet[i]
+	}
+}
@@ -0,0 +1,100 @@
+package idgen
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const (
+	StrategyBase62 = "base62"
+	StrategyHashID = "hashid"
+	StrategyULID   = "ulid"
+)
+
+const Base62Alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+var ErrUnknownStrategy = errors.New("unknown id strategy")
+var ErrBadAlphabet = errors.New("bad id alphabet")
+var ErrBadLength = errors.New("bad id length")
+var ErrMissingSalt = errors.New("id salt is required")
+
+// Generator produces short URL IDs. seq is a unique, increasing number
+// provided by the storage; strategies which do not rely on it ignore it.
+// Storages retry with a new seq when the produced ID is already taken.
+type Generator interface {
+	Generate(seq uint64) (string, error)
+}
+
+// New creates a generator for the given strategy. length and alphabet are
+// ignored by ULID, which always produces 26 Crockford base32 characters.
+func New(strategy string, length int, alphabet, salt string) (Generator, error) {
+	switch strategy {
+	case StrategyBase62:
+		return NewRandom(length, alphabet)
+	case StrategyHashID:
+		return NewHashID(length, alphabet, salt)
+	case StrategyULID:
+		return NewULID(), nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownStrategy, strategy)
+}
+
+func uniqueAlphabet(alphabet string) ([]byte, error) {
+	seen := make(map[byte]bool)
+	res := make([]byte, 0, len(alphabet))
+
+	for i := 0; i < len(alphabet); i++ {
+		c := alphabet[i]
+		if c > 127 || c == ' ' {
+			return nil, fmt.Errorf("%w: only ASCII characters without spaces are allowed", ErrBadAlphabet)
+		}
+
+		if !seen[c] {
+			seen[c] = true
+			res = append(res, c)
+		}
+	}
+
+	return res, nil
+}
+
+// Random produces cryptographically random IDs of a fixed length.
+type Random struct {
+	length   int
+	alphabet []byte
+}
+
+func NewRandom(length int, alphabet string) (*Random, error) {
+	if length <= 0 {
+		return nil, ErrBadLength
+	}
+
+	chars, err := uniqueAlphabet(alphabet)
+	if err != nil {
+		return nil, err
+	}
+	if len(chars) < 2 {
+		return nil, fmt.Errorf("%w: at least 2 characters are required", ErrBadAlphabet)
+	}
+
+	return &Random{length: length, alphabet: chars}, nil
+}
+
+func (g *Random) Generate(seq uint64) (string, error) {
+	max := big.NewInt(int64(len(g.alphabet)))
+	res := make([]byte, g.length)
+
+	for i := range res {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+
+		res[i] = g.alphabet[n.Int64()]
+	}
+
+	return string(res), nil
+}
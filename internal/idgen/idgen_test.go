@@ -0,0 +1,62 @@
+package idgen_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/GermanVor/shortener-pet-project/internal/idgen"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerators(t *testing.T) {
+	t.Run("base62", func(tt *testing.T) {
+		gen, err := idgen.New(idgen.StrategyBase62, 10, "abc", "")
+		require.NoError(tt, err)
+
+		id, err := gen.Generate(1)
+		require.NoError(tt, err)
+		require.Len(tt, id, 10)
+		require.Empty(tt, strings.Trim(id, "abc"))
+	})
+
+	t.Run("hashid", func(tt *testing.T) {
+		gen, err := idgen.New(idgen.StrategyHashID, 6, idgen.Base62Alphabet, "salt")
+		require.NoError(tt, err)
+
+		seen := make(map[string]bool)
+		for seq := uint64(1); seq <= 10000; seq++ {
+			id, err := gen.Generate(seq)
+			require.NoError(tt, err)
+			require.GreaterOrEqual(tt, len(id), 6)
+			require.False(tt, seen[id], id)
+
+			seen[id] = true
+		}
+
+		other, err := idgen.New(idgen.StrategyHashID, 6, idgen.Base62Alphabet, "other salt")
+		require.NoError(tt, err)
+
+		id, _ := gen.Generate(1)
+		otherID, _ := other.Generate(1)
+		require.NotEqual(tt, id, otherID)
+
+		_, err = idgen.New(idgen.StrategyHashID, 6, "abc", "salt")
+		require.ErrorIs(tt, err, idgen.ErrBadAlphabet)
+
+		_, err = idgen.New(idgen.StrategyHashID, 6, idgen.Base62Alphabet, "")
+		require.ErrorIs(tt, err, idgen.ErrMissingSalt)
+	})
+
+	t.Run("ulid", func(tt *testing.T) {
+		gen, err := idgen.New(idgen.StrategyULID, 0, "", "")
+		require.NoError(tt, err)
+
+		first, err := gen.Generate(0)
+		require.NoError(tt, err)
+		require.Len(tt, first, 26)
+		require.LessOrEqual(tt, first[0], byte('7'))
+	})
+
+	_, err := idgen.New("serial", 8, idgen.Base62Alphabet, "")
+	require.ErrorIs(t, err, idgen.ErrUnknownStrategy)
+}
@@ -0,0 +1,53 @@
+package idgen
+
+import (
+	"crypto/rand"
+	"time"
+)
+
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULID produces 26 character lexicographically sortable IDs: 48 bits of
+// millisecond timestamp followed by 80 random bits.
+type ULID struct {
+	now func() time.Time
+}
+
+func NewULID() *ULID {
+	return &ULID{now: time.Now}
+}
+
+func (g *ULID) Generate(seq uint64) (string, error) {
+	var data [16]byte
+
+	ms := uint64(g.now().UnixMilli())
+	for i := 5; i >= 0; i-- {
+		data[i] = byte(ms)
+		ms >>= 8
+	}
+
+	if _, err := rand.Read(data[6:]); err != nil {
+		return "", err
+	}
+
+	// 128 bits are encoded into 26 characters of 5 bits, the first character
+	// only carries the 3 most significant bits.
+	res := make([]byte, 26)
+	bitPos := -2
+	for i := range res {
+		value := 0
+		for bit := 0; bit < 5; bit++ {
+			value <<= 1
+
+			pos := bitPos + bit
+			if pos >= 0 && data[pos/8]&(0x80>>(pos%8)) != 0 {
+				value |= 1
+			}
+		}
+
+		res[i] = crockfordAlphabet[value]
+		bitPos += 5
+	}
+
+	return string(res), nil
+}
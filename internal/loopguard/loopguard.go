@@ -0,0 +1,108 @@
+package loopguard
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/GermanVor/shortener-pet-project/internal/urlpolicy"
+)
+
+// MaxHops is the amount of own short links followed before giving up with
+// ErrRedirectLoop.
+const MaxHops = 5
+
+var ErrOwnURL = errors.New("url points to this shortener")
+var ErrShortenerURL = errors.New("url points to another shortener")
+var ErrRedirectLoop = errors.New("url redirects too many times")
+
+// Guard recognizes the URLs pointing to the shortener itself or to the other
+// shorteners, shortening them makes redirect chains and loops. A nil *Guard
+// recognizes nothing.
+type Guard struct {
+	// host and path of the base URL the short links are made of.
+	host string
+	path string
+
+	// shorteners are the domains of the other shorteners, their subdomains
+	// are matched too.
+	shorteners map[string]bool
+}
+
+// New makes a guard of the base URL and the other shorteners domains.
+func New(baseURL string, shortenerDomains []string) (*Guard, error) {
+	canonicalURL, err := urlpolicy.Normalize(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad base URL %q: %w", baseURL, err)
+	}
+
+	parsed, err := url.Parse(canonicalURL)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Guard{
+		host:       parsed.Host,
+		path:       strings.TrimSuffix(parsed.Path, "/") + "/",
+		shorteners: make(map[string]bool),
+	}
+
+	for _, domain := range shortenerDomains {
+		if domain = strings.TrimSpace(domain); domain == "" {
+			continue
+		}
+
+		canonicalURL, err := urlpolicy.Normalize("http://" + domain)
+		if err != nil {
+			return nil, fmt.Errorf("bad shortener domain %q: %w", domain, err)
+		}
+
+		parsed, err := url.Parse(canonicalURL)
+		if err != nil {
+			return nil, err
+		}
+
+		g.shorteners[parsed.Hostname()] = true
+	}
+
+	return g, nil
+}
+
+// ShortURLId returns the id of the short link the canonical URL is, ok is
+// false when the URL does not point to the shortener. The other shorteners
+// URLs and the shortener URLs which are not short links are rejected.
+func (g *Guard) ShortURLId(canonicalURL string) (id string, ok bool, err error) {
+	if g == nil {
+		return "", false, nil
+	}
+
+	parsed, err := url.Parse(canonicalURL)
+	if err != nil {
+		return "", false, nil
+	}
+
+	if parsed.Host != g.host {
+		for host := parsed.Hostname(); host != ""; {
+			if g.shorteners[host] {
+				return "", false, ErrShortenerURL
+			}
+
+			dot := strings.IndexByte(host, '.')
+			if dot == -1 {
+				break
+			}
+
+			host = host[dot+1:]
+		}
+
+		return "", false, nil
+	}
+
+	id = strings.TrimPrefix(parsed.Path, g.path)
+	if len(id) == len(parsed.Path) || id == "" || strings.Contains(id, "/") {
+		return "", false, ErrOwnURL
+	}
+
+	return id, true, nil
+}
@@ -0,0 +1,55 @@
+package loopguard_test
+
+import (
+	"testing"
+
+	"github.com/GermanVor/shortener-pet-project/internal/loopguard"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShortURLId(t *testing.T) {
+	guard, err := loopguard.New("http://Short.biz/s", []string{"bit.ly", " ", "Пример.рф"})
+	require.NoError(t, err)
+
+	own := map[string]string{
+		"http://short.biz/s/abc":         "abc",
+		"https://short.biz/s/abc?utm=1":  "abc",
+		"http://short.biz/s/abc#section": "abc",
+	}
+
+	for canonicalURL, expected := range own {
+		id, ok, err := guard.ShortURLId(canonicalURL)
+		require.NoError(t, err, canonicalURL)
+		require.True(t, ok, canonicalURL)
+		require.Equal(t, expected, id, canonicalURL)
+	}
+
+	rejected := map[string]error{
+		"http://short.biz/":                loopguard.ErrOwnURL,
+		"http://short.biz/s/":              loopguard.ErrOwnURL,
+		"http://short.biz/api/user/urls":   loopguard.ErrOwnURL,
+		"http://short.biz/s/api/user/urls": loopguard.ErrOwnURL,
+		"https://bit.ly/abc":               loopguard.ErrShortenerURL,
+		"https://www.bit.ly/abc":           loopguard.ErrShortenerURL,
+		"http://xn--e1afmkfd.xn--p1ai/abc": loopguard.ErrShortenerURL,
+	}
+
+	for canonicalURL, expected := range rejected {
+		_, _, err := guard.ShortURLId(canonicalURL)
+		require.ErrorIs(t, err, expected, canonicalURL)
+	}
+
+	for _, canonicalURL := range []string{"http://short.biz:8080/s/abc", "http://notbit.ly/abc", "http://oknetcumk.biz/s/abc"} {
+		_, ok, err := guard.ShortURLId(canonicalURL)
+		require.NoError(t, err, canonicalURL)
+		require.False(t, ok, canonicalURL)
+	}
+
+	var nilGuard *loopguard.Guard
+	_, ok, err := nilGuard.ShortURLId("http://short.biz/s/abc")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, err = loopguard.New("short.biz", nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,227 @@
+package migrations
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+//go:embed sql/*.sql
+var sqlFS embed.FS
+
+// Arbitrary key of the advisory lock which serializes migrations run by
+// several instances at once.
+const advisoryLockKey = 7321567
+
+var ErrBadMigrationName = errors.New("bad migration file name")
+var ErrMissingMigration = errors.New("migration is missing")
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type DB interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+type Migrator struct {
+	db         DB
+	migrations []Migration
+}
+
+// Load reads the embedded migrations. Files are named
+// `<version>_<name>.up.sql` and `<version>_<name>.down.sql`.
+func Load() ([]Migration, error) {
+	return load(sqlFS, "sql")
+}
+
+func load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+
+	for _, entry := range entries {
+		fileName := entry.Name()
+
+		base, direction := "", ""
+		if strings.HasSuffix(fileName, ".up.sql") {
+			base, direction = strings.TrimSuffix(fileName, ".up.sql"), "up"
+		} else if strings.HasSuffix(fileName, ".down.sql") {
+			base, direction = strings.TrimSuffix(fileName, ".down.sql"), "down"
+		} else {
+			return nil, fmt.Errorf("%w: %s", ErrBadMigrationName, fileName)
+		}
+
+		versionStr, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("%w: %s", ErrBadMigrationName, fileName)
+		}
+
+		body, err := fs.ReadFile(fsys, path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	res := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("%w: both up and down files are required for version %d", ErrMissingMigration, m.Version)
+		}
+
+		res = append(res, *m)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Version < res[j].Version
+	})
+
+	for i, m := range res {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("%w: version %d", ErrMissingMigration, i+1)
+		}
+	}
+
+	return res, nil
+}
+
+func New(db DB, migrations []Migration) *Migrator {
+	return &Migrator{db: db, migrations: migrations}
+}
+
+// inTx runs f in a transaction holding the migrations lock and passes it the
+// latest applied version. The versions table is created under the lock as
+// well, so the instances starting at once do not race on creating it.
+func (m *Migrator) inTx(ctx context.Context, f func(tx pgx.Tx, version int) error) error {
+	tx, err := m.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1);", advisoryLockKey); err != nil {
+		return err
+	}
+
+	sql := "CREATE TABLE IF NOT EXISTS schema_migrations (" +
+		"version integer PRIMARY KEY, " +
+		"appliedAt timestamptz NOT NULL DEFAULT now()" +
+		");"
+	if _, err = tx.Exec(ctx, sql); err != nil {
+		return err
+	}
+
+	version := 0
+	sql = "SELECT COALESCE(MAX(version), 0) FROM schema_migrations;"
+	if err = tx.QueryRow(ctx, sql).Scan(&version); err != nil {
+		return err
+	}
+
+	if err = f(tx, version); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Version returns the latest applied migration version, 0 for an empty
+// database.
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	res := 0
+	err := m.inTx(ctx, func(tx pgx.Tx, version int) error {
+		res = version
+		return nil
+	})
+
+	return res, err
+}
+
+// Up applies all pending migrations, each one in its own transaction.
+func (m *Migrator) Up(ctx context.Context) error {
+	for _, migration := range m.migrations {
+		err := m.inTx(ctx, func(tx pgx.Tx, version int) error {
+			if version >= migration.Version {
+				return nil
+			}
+
+			if _, err := tx.Exec(ctx, migration.Up); err != nil {
+				return fmt.Errorf("migration %d_%s up: %w", migration.Version, migration.Name, err)
+			}
+
+			sql := "INSERT INTO schema_migrations (version) VALUES ($1);"
+			_, err := tx.Exec(ctx, sql, migration.Version)
+			if err == nil {
+				log.Printf("Applied migration %d_%s\n", migration.Version, migration.Name)
+			}
+
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Down rolls back the given amount of the latest applied migrations.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	for i := 0; i < steps; i++ {
+		err := m.inTx(ctx, func(tx pgx.Tx, version int) error {
+			if version == 0 {
+				return nil
+			}
+
+			if version > len(m.migrations) {
+				return fmt.Errorf("%w: version %d", ErrMissingMigration, version)
+			}
+
+			migration := m.migrations[version-1]
+			if _, err := tx.Exec(ctx, migration.Down); err != nil {
+				return fmt.Errorf("migration %d_%s down: %w", migration.Version, migration.Name, err)
+			}
+
+			sql := "DELETE FROM schema_migrations WHERE version=$1;"
+			_, err := tx.Exec(ctx, sql, migration.Version)
+			if err == nil {
+				log.Printf("Rolled back migration %d_%s\n", migration.Version, migration.Name)
+			}
+
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
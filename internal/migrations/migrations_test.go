@@ -0,0 +1,220 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDB is an in-memory stand-in for Postgres which only understands the
+// schema_migrations bookkeeping and records every other statement.
+type fakeDB struct {
+	versions map[int]bool
+	executed []string
+	failOn   string
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{versions: make(map[int]bool)}
+}
+
+func (db *fakeDB) Begin(ctx context.Context) (pgx.Tx, error) {
+	versions := make(map[int]bool)
+	for version := range db.versions {
+		versions[version] = true
+	}
+
+	return &fakeTx{db: db, versions: versions}, nil
+}
+
+type fakeTx struct {
+	pgx.Tx
+
+	db       *fakeDB
+	versions map[int]bool
+	executed []string
+	locked   bool
+}
+
+func (tx *fakeTx) Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error) {
+	switch {
+	case strings.HasPrefix(sql, "SELECT pg_advisory_xact_lock"):
+		tx.locked = true
+	case strings.HasPrefix(sql, "CREATE TABLE IF NOT EXISTS schema_migrations"):
+		if !tx.locked {
+			return nil, errors.New("schema_migrations is created without the lock")
+		}
+	case strings.HasPrefix(sql, "INSERT INTO schema_migrations"):
+		tx.versions[arguments[0].(int)] = true
+	case strings.HasPrefix(sql, "DELETE FROM schema_migrations"):
+		delete(tx.versions, arguments[0].(int))
+	default:
+		if sql == tx.db.failOn {
+			return nil, errors.New("syntax error")
+		}
+
+		tx.executed = append(tx.executed, sql)
+	}
+
+	return nil, nil
+}
+
+type fakeRow struct {
+	value int
+}
+
+func (r fakeRow) Scan(dest ...interface{}) error {
+	*dest[0].(*int) = r.value
+	return nil
+}
+
+func (tx *fakeTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	max := 0
+	for version := range tx.versions {
+		if version > max {
+			max = version
+		}
+	}
+
+	return fakeRow{value: max}
+}
+
+func (tx *fakeTx) Commit(ctx context.Context) error {
+	tx.db.versions = tx.versions
+	tx.db.executed = append(tx.db.executed, tx.executed...)
+
+	return nil
+}
+
+func (tx *fakeTx) Rollback(ctx context.Context) error {
+	return nil
+}
+
+func testMigrations(t *testing.T) []Migration {
+	fsys := fstest.MapFS{
+		"sql/0001_first.up.sql":    {Data: []byte("up 1")},
+		"sql/0001_first.down.sql":  {Data: []byte("down 1")},
+		"sql/0002_second.up.sql":   {Data: []byte("up 2")},
+		"sql/0002_second.down.sql": {Data: []byte("down 2")},
+	}
+
+	res, err := load(fsys, "sql")
+	require.NoError(t, err)
+
+	return res
+}
+
+func TestLoad(t *testing.T) {
+	res, err := Load()
+	require.NoError(t, err)
+	require.NotEmpty(t, res)
+
+	for i, m := range res {
+		require.Equal(t, i+1, m.Version)
+		require.NotEmpty(t, m.Up)
+		require.NotEmpty(t, m.Down)
+	}
+
+	_, err = load(fstest.MapFS{
+		"sql/0001_first.up.sql": {Data: []byte("up 1")},
+	}, "sql")
+	require.ErrorIs(t, err, ErrMissingMigration)
+
+	_, err = load(fstest.MapFS{
+		"sql/first.up.sql": {Data: []byte("up 1")},
+	}, "sql")
+	require.ErrorIs(t, err, ErrBadMigrationName)
+}
+
+func TestUpDown(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeDB()
+	migrator := New(db, testMigrations(t))
+
+	require.NoError(t, migrator.Up(ctx))
+	require.Equal(t, []string{"up 1", "up 2"}, db.executed)
+
+	version, err := migrator.Version(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+
+	require.NoError(t, migrator.Up(ctx))
+	require.Equal(t, []string{"up 1", "up 2"}, db.executed)
+
+	require.NoError(t, migrator.Down(ctx, 1))
+	require.Equal(t, []string{"up 1", "up 2", "down 2"}, db.executed)
+
+	require.NoError(t, migrator.Down(ctx, 5))
+	require.Equal(t, []string{"up 1", "up 2", "down 2", "down 1"}, db.executed)
+
+	version, err = migrator.Version(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, version)
+}
+
+func TestUpFailure(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeDB()
+	db.failOn = "up 2"
+	migrator := New(db, testMigrations(t))
+
+	require.Error(t, migrator.Up(ctx))
+	require.Equal(t, map[int]bool{1: true}, db.versions)
+	require.Equal(t, []string{"up 1"}, db.executed)
+}
+
+// TestPostgres applies all the embedded migrations to a throwaway schema of
+// the database from TEST_DATABASE_DSN.
+func TestPostgres(t *testing.T) {
+	connString, ok := os.LookupEnv("TEST_DATABASE_DSN")
+	if !ok {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	ctx := context.Background()
+	schema := fmt.Sprintf("migrations_test_%d", os.Getpid())
+
+	admin, err := pgxpool.Connect(ctx, connString)
+	require.NoError(t, err)
+	defer admin.Close()
+
+	_, err = admin.Exec(ctx, "CREATE SCHEMA "+schema+";")
+	require.NoError(t, err)
+	defer admin.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE;")
+
+	config, err := pgxpool.ParseConfig(connString)
+	require.NoError(t, err)
+	config.ConnConfig.RuntimeParams["search_path"] = schema
+
+	conn, err := pgxpool.ConnectConfig(ctx, config)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	migrationsList, err := Load()
+	require.NoError(t, err)
+
+	migrator := New(conn, migrationsList)
+
+	require.NoError(t, migrator.Up(ctx))
+
+	version, err := migrator.Version(ctx)
+	require.NoError(t, err)
+	require.Equal(t, len(migrationsList), version)
+
+	require.NoError(t, migrator.Down(ctx, len(migrationsList)))
+
+	version, err = migrator.Version(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, version)
+
+	require.NoError(t, migrator.Up(ctx))
+}
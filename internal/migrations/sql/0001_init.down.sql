@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS usersArchive;
+DROP TABLE IF EXISTS shortensArchive;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS shortensArchive (
+	originalURL text UNIQUE,
+	shortenURLId SERIAL
+);
+
+CREATE TABLE IF NOT EXISTS usersArchive (
+	userUUID text,
+	shortenURLId text,
+	isPresent boolean DEFAULT TRUE,
+	PRIMARY KEY (userUUID, shortenURLId)
+);
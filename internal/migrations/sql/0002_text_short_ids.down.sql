@@ -0,0 +1,11 @@
+ALTER TABLE shortensArchive DROP CONSTRAINT shortensArchive_shortenURLId_key;
+
+-- Generated IDs can not be represented by the integer column.
+DELETE FROM shortensArchive WHERE shortenURLId !~ '^[0-9]+$';
+ALTER TABLE shortensArchive ALTER COLUMN shortenURLId TYPE integer USING shortenURLId::integer;
+
+CREATE SEQUENCE shortensArchive_shortenURLId_seq OWNED BY shortensArchive.shortenURLId;
+SELECT setval('shortensArchive_shortenURLId_seq', COALESCE((SELECT MAX(shortenURLId) FROM shortensArchive), 0) + 1, false);
+ALTER TABLE shortensArchive ALTER COLUMN shortenURLId SET DEFAULT nextval('shortensArchive_shortenURLId_seq');
+
+DROP SEQUENCE shortensArchive_seq;
@@ -0,0 +1,8 @@
+CREATE SEQUENCE IF NOT EXISTS shortensArchive_seq;
+SELECT setval('shortensArchive_seq', COALESCE((SELECT MAX(shortenURLId) FROM shortensArchive), 0) + 1, false);
+
+ALTER TABLE shortensArchive ALTER COLUMN shortenURLId DROP DEFAULT;
+DROP SEQUENCE IF EXISTS shortensArchive_shortenURLId_seq;
+
+ALTER TABLE shortensArchive ALTER COLUMN shortenURLId TYPE text USING shortenURLId::text;
+ALTER TABLE shortensArchive ADD CONSTRAINT shortensArchive_shortenURLId_key UNIQUE (shortenURLId);
@@ -0,0 +1,2 @@
+DROP INDEX shortensArchive_expiresAt_idx;
+ALTER TABLE shortensArchive DROP COLUMN expiresAt;
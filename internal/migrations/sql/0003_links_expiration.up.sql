@@ -0,0 +1,2 @@
+ALTER TABLE shortensArchive ADD COLUMN expiresAt timestamptz;
+CREATE INDEX shortensArchive_expiresAt_idx ON shortensArchive (expiresAt) WHERE expiresAt IS NOT NULL;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS clicks (
+	shortenURLId text NOT NULL,
+	clickedAt timestamptz NOT NULL,
+	referrer text NOT NULL DEFAULT '',
+	userAgent text NOT NULL DEFAULT '',
+	ipHash text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX clicks_shortenURLId_clickedAt_idx ON clicks (shortenURLId, clickedAt);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS apiKeys (
+	id text PRIMARY KEY,
+	userUUID text NOT NULL,
+	name text NOT NULL DEFAULT '',
+	keyHash text NOT NULL UNIQUE,
+	createdAt timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX apiKeys_userUUID_idx ON apiKeys (userUUID);
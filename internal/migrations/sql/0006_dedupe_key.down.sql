@@ -0,0 +1,16 @@
+ALTER TABLE shortensArchive DROP CONSTRAINT shortensArchive_dedupeKey_key;
+ALTER TABLE shortensArchive DROP COLUMN dedupeKey;
+
+-- Only one link of a URL can be kept by the unique constraint.
+DELETE FROM usersArchive WHERE shortenURLId IN (
+	SELECT a.shortenURLId FROM shortensArchive a, shortensArchive b
+	WHERE a.originalURL = b.originalURL AND a.shortenURLId > b.shortenURLId
+);
+DELETE FROM clicks WHERE shortenURLId IN (
+	SELECT a.shortenURLId FROM shortensArchive a, shortensArchive b
+	WHERE a.originalURL = b.originalURL AND a.shortenURLId > b.shortenURLId
+);
+DELETE FROM shortensArchive a USING shortensArchive b
+WHERE a.originalURL = b.originalURL AND a.shortenURLId > b.shortenURLId;
+
+ALTER TABLE shortensArchive ADD CONSTRAINT shortensArchive_originalURL_key UNIQUE (originalURL);
@@ -0,0 +1,6 @@
+-- Links are deduplicated by a key depending on the configured scope, links
+-- without the key are never reused.
+ALTER TABLE shortensArchive DROP CONSTRAINT IF EXISTS shortensArchive_originalURL_key;
+ALTER TABLE shortensArchive ADD COLUMN dedupeKey text;
+UPDATE shortensArchive SET dedupeKey = originalURL;
+ALTER TABLE shortensArchive ADD CONSTRAINT shortensArchive_dedupeKey_key UNIQUE (dedupeKey);
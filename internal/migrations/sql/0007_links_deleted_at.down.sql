@@ -0,0 +1,2 @@
+DROP INDEX usersArchive_deletedAt_idx;
+ALTER TABLE usersArchive DROP COLUMN deletedAt;
@@ -0,0 +1,6 @@
+ALTER TABLE usersArchive ADD COLUMN deletedAt timestamptz;
+
+-- The retention period of the links deleted before starts now.
+UPDATE usersArchive SET deletedAt = now() WHERE NOT isPresent;
+
+CREATE INDEX usersArchive_deletedAt_idx ON usersArchive (deletedAt) WHERE deletedAt IS NOT NULL;
@@ -0,0 +1 @@
+ALTER TABLE shortensArchive DROP COLUMN createdAt;
@@ -0,0 +1,2 @@
+-- The links created before the column existed get the migration time.
+ALTER TABLE shortensArchive ADD COLUMN createdAt timestamptz NOT NULL DEFAULT now();
@@ -0,0 +1,4 @@
+ALTER TABLE shortensArchive DROP COLUMN description;
+ALTER TABLE shortensArchive DROP COLUMN title;
+ALTER TABLE shortensArchive DROP COLUMN updatedAt;
+ALTER TABLE shortensArchive DROP COLUMN createdBy;
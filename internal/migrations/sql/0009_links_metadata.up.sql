@@ -0,0 +1,7 @@
+-- The creator of the links created before the column existed is unknown.
+ALTER TABLE shortensArchive ADD COLUMN createdBy text NOT NULL DEFAULT '';
+ALTER TABLE shortensArchive ADD COLUMN updatedAt timestamptz NOT NULL DEFAULT now();
+ALTER TABLE shortensArchive ADD COLUMN title text NOT NULL DEFAULT '';
+ALTER TABLE shortensArchive ADD COLUMN description text NOT NULL DEFAULT '';
+
+UPDATE shortensArchive SET updatedAt = createdAt;
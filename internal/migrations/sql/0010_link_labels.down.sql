@@ -0,0 +1,2 @@
+DROP TABLE linkTags;
+ALTER TABLE usersArchive DROP COLUMN folder;
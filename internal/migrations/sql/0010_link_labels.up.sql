@@ -0,0 +1,11 @@
+ALTER TABLE usersArchive ADD COLUMN folder text NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS linkTags (
+	userUUID text NOT NULL,
+	shortenURLId text NOT NULL,
+	tag text NOT NULL,
+	PRIMARY KEY (userUUID, shortenURLId, tag),
+	FOREIGN KEY (userUUID, shortenURLId) REFERENCES usersArchive (userUUID, shortenURLId) ON DELETE CASCADE
+);
+
+CREATE INDEX linkTags_userUUID_tag_idx ON linkTags (userUUID, tag);
@@ -0,0 +1 @@
+ALTER TABLE shortensArchive ADD COLUMN preview boolean NOT NULL DEFAULT false;
@@ -0,0 +1,100 @@
+package preview
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/url"
+	"os"
+	"time"
+)
+
+//go:embed templates/*.html
+var templatesFS embed.FS
+
+// PageTemplate is the name of the template rendering the preview page.
+const PageTemplate = "preview.html"
+
+var ErrNoPageTemplate = errors.New("preview page template is missing")
+
+// Page is the data the preview page template is executed with.
+type Page struct {
+	ShortURL    string
+	OriginalURL string
+	// Host of the original URL, it is shown apart as the part which matters.
+	Host        string
+	Title       string
+	Description string
+	// CreatedAt is zero when it is unknown.
+	CreatedAt time.Time
+}
+
+// NewPage fills the page of the link.
+func NewPage(shortURL, originalURL, title, description string, createdAt time.Time) Page {
+	page := Page{
+		ShortURL:    shortURL,
+		OriginalURL: originalURL,
+		Title:       title,
+		Description: description,
+		CreatedAt:   createdAt,
+	}
+
+	if parsed, err := url.Parse(originalURL); err == nil {
+		page.Host = parsed.Hostname()
+	}
+
+	return page
+}
+
+// Renderer renders the preview pages with the templates embedded in the binary.
+type Renderer struct {
+	templates *template.Template
+}
+
+// New parses the embedded templates, the *.html files of dir override the
+// templates of the same name. An empty dir uses the embedded ones only.
+func New(dir string) (*Renderer, error) {
+	templates, err := template.ParseFS(templatesFS, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	if dir != "" {
+		if _, err = os.Stat(dir); err != nil {
+			return nil, err
+		}
+
+		dirFS := os.DirFS(dir)
+
+		overrides, err := fs.Glob(dirFS, "*.html")
+		if err != nil {
+			return nil, err
+		}
+
+		if len(overrides) != 0 {
+			if templates, err = templates.ParseFS(dirFS, "*.html"); err != nil {
+				return nil, fmt.Errorf("preview templates of %s: %w", dir, err)
+			}
+		}
+	}
+
+	if templates.Lookup(PageTemplate) == nil {
+		return nil, ErrNoPageTemplate
+	}
+
+	return &Renderer{templates: templates}, nil
+}
+
+// Render returns the preview page, nothing is returned if the template fails
+// half way.
+func (r *Renderer) Render(page Page) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := r.templates.ExecuteTemplate(buf, PageTemplate, page); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
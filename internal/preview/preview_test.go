@@ -0,0 +1,64 @@
+package preview_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GermanVor/shortener-pet-project/internal/preview"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRender(t *testing.T) {
+	renderer, err := preview.New("")
+	require.NoError(t, err)
+
+	createdAt := time.Date(2022, time.March, 8, 12, 0, 0, 0, time.UTC)
+	page := preview.NewPage("http://127.0.0.1:8080/abc", "http://oknetcumk.biz/sale?a=1&b=2", "<b>Sale</b>", "Landing page", createdAt)
+	require.Equal(t, "oknetcumk.biz", page.Host)
+
+	pageBytes, err := renderer.Render(page)
+	require.NoError(t, err)
+
+	html := string(pageBytes)
+	require.Contains(t, html, "&lt;b&gt;Sale&lt;/b&gt;")
+	require.NotContains(t, html, "<b>Sale</b>")
+	require.Contains(t, html, `href="http://oknetcumk.biz/sale?a=1&amp;b=2"`)
+	require.Contains(t, html, "Landing page")
+	require.Contains(t, html, "8 Mar 2022")
+	require.Contains(t, html, "http://127.0.0.1:8080/abc")
+
+	pageBytes, err = renderer.Render(preview.NewPage("http://127.0.0.1:8080/abc", "javascript:alert(1)", "", "", time.Time{}))
+	require.NoError(t, err)
+	require.NotContains(t, string(pageBytes), `href="javascript:`)
+}
+
+func TestOverride(t *testing.T) {
+	dir := t.TempDir()
+
+	renderer, err := preview.New(dir)
+	require.NoError(t, err)
+
+	pageBytes, err := renderer.Render(preview.NewPage("http://127.0.0.1:8080/abc", "http://oknetcumk.biz/", "", "", time.Time{}))
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(pageBytes), "<!DOCTYPE html>"))
+
+	override := `<p>{{.Host}} via {{.ShortURL}}</p>`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, preview.PageTemplate), []byte(override), 0644))
+
+	renderer, err = preview.New(dir)
+	require.NoError(t, err)
+
+	pageBytes, err = renderer.Render(preview.NewPage("http://127.0.0.1:8080/abc", "http://oknetcumk.biz/", "", "", time.Time{}))
+	require.NoError(t, err)
+	require.Equal(t, "<p>oknetcumk.biz via http://127.0.0.1:8080/abc</p>", string(pageBytes))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, preview.PageTemplate), []byte("{{.Broken"), 0644))
+	_, err = preview.New(dir)
+	require.Error(t, err)
+
+	_, err = preview.New(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
@@ -0,0 +1,259 @@
+package qr
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"sync"
+
+	"github.com/skip2/go-qrcode"
+)
+
+type Format string
+
+const (
+	FormatPNG Format = "png"
+	FormatSVG Format = "svg"
+)
+
+// Limits and defaults of the options, the size is in pixels and the margin is
+// in modules.
+const (
+	DefaultSize   = 256
+	MinSize       = 64
+	MaxSize       = 2048
+	DefaultMargin = 4
+	MaxMargin     = 16
+	DefaultLevel  = "M"
+
+	DefaultCacheSize = 1024
+)
+
+var ErrUnknownFormat = errors.New("qr format must be png or svg")
+var ErrBadSize = fmt.Errorf("qr size must be %d-%d", MinSize, MaxSize)
+var ErrBadMargin = fmt.Errorf("qr margin must be 0-%d", MaxMargin)
+var ErrUnknownLevel = errors.New("qr error correction level must be L, M, Q or H")
+var ErrSizeTooSmall = errors.New("qr size is too small for the content")
+
+var levels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// Options of the QR code image.
+type Options struct {
+	Format Format
+	Size   int
+	// Level is the error correction level: L, M, Q or H.
+	Level  string
+	Margin int
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Format: FormatPNG,
+		Size:   DefaultSize,
+		Level:  DefaultLevel,
+		Margin: DefaultMargin,
+	}
+}
+
+func (opts Options) Validate() error {
+	if opts.Format != FormatPNG && opts.Format != FormatSVG {
+		return ErrUnknownFormat
+	}
+
+	if opts.Size < MinSize || opts.Size > MaxSize {
+		return ErrBadSize
+	}
+
+	if opts.Margin < 0 || opts.Margin > MaxMargin {
+		return ErrBadMargin
+	}
+
+	if _, ok := levels[opts.Level]; !ok {
+		return ErrUnknownLevel
+	}
+
+	return nil
+}
+
+func (opts Options) ContentType() string {
+	if opts.Format == FormatSVG {
+		return "image/svg+xml"
+	}
+
+	return "image/png"
+}
+
+// Render encodes the content to the QR code image.
+func Render(content string, opts Options) ([]byte, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	code, err := qrcode.New(content, levels[opts.Level])
+	if err != nil {
+		return nil, err
+	}
+
+	code.DisableBorder = true
+	modules := code.Bitmap()
+
+	// The image is a square of the modules surrounded by the margin.
+	total := len(modules) + 2*opts.Margin
+	if total > opts.Size {
+		return nil, ErrSizeTooSmall
+	}
+
+	if opts.Format == FormatSVG {
+		return renderSVG(modules, opts.Margin, total, opts.Size), nil
+	}
+
+	return renderPNG(modules, opts.Margin, total, opts.Size)
+}
+
+func renderPNG(modules [][]bool, margin, total, size int) ([]byte, error) {
+	scale := size / total
+	// The pixels left over are spread around the margin.
+	offset := (size-scale*total)/2 + margin*scale
+
+	palette := color.Palette{color.White, color.Black}
+	img := image.NewPaletted(image.Rect(0, 0, size, size), palette)
+
+	for y, row := range modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex(offset+x*scale+dx, offset+y*scale+dy, 1)
+				}
+			}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// renderSVG draws the dark modules of a row by horizontal runs, the image is
+// scaled by the viewer so the modules stay sharp at any size.
+func renderSVG(modules [][]bool, margin, total, size int) []byte {
+	path := &strings.Builder{}
+	for y, row := range modules {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+
+			start := x
+			for x < len(row) && row[x] {
+				x++
+			}
+
+			fmt.Fprintf(path, "M%d %dh%dv1h-%dz", start+margin, y+margin, x-start, x-start)
+		}
+	}
+
+	svg := &strings.Builder{}
+	fmt.Fprintf(svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, total, total)
+	fmt.Fprintf(svg, `<rect width="%d" height="%d" fill="#fff"/>`, total, total)
+	fmt.Fprintf(svg, `<path d="%s" fill="#000"/>`, path.String())
+	svg.WriteString("</svg>")
+
+	return []byte(svg.String())
+}
+
+// DataURI returns the image as a data URI.
+func DataURI(image []byte, opts Options) string {
+	return "data:" + opts.ContentType() + ";base64," + base64.StdEncoding.EncodeToString(image)
+}
+
+type cacheKey struct {
+	content string
+	opts    Options
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	image []byte
+}
+
+// Cache keeps the least recently used images, as the short links never change
+// their URLs the images are never stale. A nil *Cache renders every time.
+type Cache struct {
+	mux     sync.Mutex
+	size    int
+	order   *list.List
+	entries map[cacheKey]*list.Element
+}
+
+func NewCache(size int) *Cache {
+	return &Cache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[cacheKey]*list.Element),
+	}
+}
+
+// Render returns the cached image rendering it on a miss.
+func (c *Cache) Render(content string, opts Options) ([]byte, error) {
+	if c == nil || c.size <= 0 {
+		return Render(content, opts)
+	}
+
+	key := cacheKey{content: content, opts: opts}
+
+	c.mux.Lock()
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		image := element.Value.(*cacheEntry).image
+		c.mux.Unlock()
+
+		return image, nil
+	}
+	c.mux.Unlock()
+
+	image, err := Render(content, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.order.PushFront(&cacheEntry{key: key, image: image})
+
+		if c.order.Len() > c.size {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*cacheEntry).key)
+		}
+	}
+
+	return image, nil
+}
+
+// Len returns the amount of the cached images.
+func (c *Cache) Len() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.order.Len()
+}
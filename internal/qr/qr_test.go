@@ -0,0 +1,103 @@
+package qr_test
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/GermanVor/shortener-pet-project/internal/qr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRender(t *testing.T) {
+	opts := qr.DefaultOptions()
+
+	image, err := qr.Render("http://127.0.0.1:8080/abc", opts)
+	require.NoError(t, err)
+
+	decoded, err := png.Decode(bytes.NewReader(image))
+	require.NoError(t, err)
+	require.Equal(t, opts.Size, decoded.Bounds().Dx())
+	require.Equal(t, opts.Size, decoded.Bounds().Dy())
+
+	// The corners are the margin and the finder pattern next to it.
+	r, _, _, _ := decoded.At(0, 0).RGBA()
+	require.Equal(t, uint32(0xffff), r)
+
+	opts.Margin = 0
+	image, err = qr.Render("http://127.0.0.1:8080/abc", opts)
+	require.NoError(t, err)
+
+	decoded, err = png.Decode(bytes.NewReader(image))
+	require.NoError(t, err)
+
+	center := opts.Size / 2
+	for x := 0; x < center; x++ {
+		if r, _, _, _ = decoded.At(x, x).RGBA(); r == 0 {
+			break
+		}
+	}
+	require.Equal(t, uint32(0), r)
+
+	opts = qr.DefaultOptions()
+	opts.Format = qr.FormatSVG
+	image, err = qr.Render("http://127.0.0.1:8080/abc", opts)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(image), "<svg "))
+	require.Contains(t, string(image), `width="256"`)
+	require.Equal(t, "image/svg+xml", opts.ContentType())
+
+	low, high := qr.DefaultOptions(), qr.DefaultOptions()
+	low.Level, high.Level = "L", "H"
+	lowImage, err := qr.Render(strings.Repeat("http://127.0.0.1:8080/abc", 4), low)
+	require.NoError(t, err)
+	highImage, err := qr.Render(strings.Repeat("http://127.0.0.1:8080/abc", 4), high)
+	require.NoError(t, err)
+	require.NotEqual(t, lowImage, highImage)
+
+	invalid := map[error]func(opts *qr.Options){
+		qr.ErrUnknownFormat: func(opts *qr.Options) { opts.Format = "gif" },
+		qr.ErrBadSize:       func(opts *qr.Options) { opts.Size = qr.MaxSize + 1 },
+		qr.ErrBadMargin:     func(opts *qr.Options) { opts.Margin = -1 },
+		qr.ErrUnknownLevel:  func(opts *qr.Options) { opts.Level = "X" },
+	}
+
+	for expected, change := range invalid {
+		opts := qr.DefaultOptions()
+		change(&opts)
+
+		_, err = qr.Render("http://127.0.0.1:8080/abc", opts)
+		require.ErrorIs(t, err, expected)
+	}
+
+	opts = qr.DefaultOptions()
+	opts.Size, opts.Margin = qr.MinSize, qr.MaxMargin
+	_, err = qr.Render(strings.Repeat("http://127.0.0.1:8080/abc", 10), opts)
+	require.ErrorIs(t, err, qr.ErrSizeTooSmall)
+}
+
+func TestCache(t *testing.T) {
+	cache := qr.NewCache(2)
+	opts := qr.DefaultOptions()
+
+	first, err := cache.Render("http://127.0.0.1:8080/1", opts)
+	require.NoError(t, err)
+
+	again, err := cache.Render("http://127.0.0.1:8080/1", opts)
+	require.NoError(t, err)
+	require.Equal(t, first, again)
+	require.Equal(t, 1, cache.Len())
+
+	opts.Format = qr.FormatSVG
+	_, err = cache.Render("http://127.0.0.1:8080/1", opts)
+	require.NoError(t, err)
+	_, err = cache.Render("http://127.0.0.1:8080/2", opts)
+	require.NoError(t, err)
+	require.Equal(t, 2, cache.Len())
+
+	var nilCache *qr.Cache
+	image, err := nilCache.Render("http://127.0.0.1:8080/1", qr.DefaultOptions())
+	require.NoError(t, err)
+	require.Equal(t, first, image)
+}
@@ -0,0 +1,159 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+const (
+	signedPrefix    = "s1."
+	encryptedPrefix = "e1."
+
+	// Keys shorter than that are too easy to brute force.
+	MinKeyLength = 16
+)
+
+var ErrNoKeys = errors.New("at least one session key is required")
+var ErrShortKey = errors.New("session key is too short")
+var ErrInvalidToken = errors.New("invalid session token")
+
+type key struct {
+	mac []byte
+	enc cipher.AEAD
+}
+
+func deriveKey(secret, label string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func newKey(secret string) (*key, error) {
+	if len(secret) < MinKeyLength {
+		return nil, ErrShortKey
+	}
+
+	block, err := aes.NewCipher(deriveKey(secret, "encryption"))
+	if err != nil {
+		return nil, err
+	}
+
+	enc, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key{mac: deriveKey(secret, "signature"), enc: enc}, nil
+}
+
+// Codec turns user IDs into tamper-proof session tokens and back.
+//
+// The first key signs new tokens, all the keys are accepted when verifying,
+// so a key can be rotated by putting the new one first while keeping the old
+// one until the issued tokens are refreshed.
+type Codec struct {
+	keys    []*key
+	encrypt bool
+}
+
+func NewCodec(secrets []string, encrypt bool) (*Codec, error) {
+	if len(secrets) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	c := &Codec{encrypt: encrypt}
+	for _, secret := range secrets {
+		k, err := newKey(secret)
+		if err != nil {
+			return nil, err
+		}
+
+		c.keys = append(c.keys, k)
+	}
+
+	return c, nil
+}
+
+func (k *key) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, k.mac)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Encode returns the token of userID signed, and encrypted if the codec is
+// configured so, with the active key.
+func (c *Codec) Encode(userID string) (string, error) {
+	k := c.keys[0]
+
+	prefix, payload := signedPrefix, []byte(userID)
+	if c.encrypt {
+		nonce := make([]byte, k.enc.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+
+		prefix, payload = encryptedPrefix, k.enc.Seal(nonce, nonce, payload, nil)
+	}
+
+	signed := prefix + base64.RawURLEncoding.EncodeToString(payload)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(k.sign([]byte(signed))), nil
+}
+
+// Decode verifies the token and returns its user ID. stale is true when the
+// token was issued with an old key or with other encryption settings and
+// should be replaced.
+func (c *Codec) Decode(token string) (userID string, stale bool, err error) {
+	dotIdx := strings.LastIndexByte(token, '.')
+	if dotIdx < 0 {
+		return "", false, ErrInvalidToken
+	}
+
+	signed := token[:dotIdx]
+	signature, err := base64.RawURLEncoding.DecodeString(token[dotIdx+1:])
+	if err != nil {
+		return "", false, ErrInvalidToken
+	}
+
+	isEncrypted := strings.HasPrefix(signed, encryptedPrefix)
+	if !isEncrypted && !strings.HasPrefix(signed, signedPrefix) {
+		return "", false, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(signed[len(signedPrefix):])
+	if err != nil {
+		return "", false, ErrInvalidToken
+	}
+
+	for i, k := range c.keys {
+		if !hmac.Equal(signature, k.sign([]byte(signed))) {
+			continue
+		}
+
+		stale = i != 0 || isEncrypted != c.encrypt
+
+		if !isEncrypted {
+			return string(payload), stale, nil
+		}
+
+		nonceSize := k.enc.NonceSize()
+		if len(payload) < nonceSize {
+			return "", false, ErrInvalidToken
+		}
+
+		plain, err := k.enc.Open(nil, payload[:nonceSize], payload[nonceSize:], nil)
+		if err != nil {
+			return "", false, ErrInvalidToken
+		}
+
+		return string(plain), stale, nil
+	}
+
+	return "", false, ErrInvalidToken
+}
@@ -0,0 +1,55 @@
+package session_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/GermanVor/shortener-pet-project/internal/session"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	oldKey = "old-secret-key-0123456789"
+	newKey = "new-secret-key-0123456789"
+)
+
+func TestCodec(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		codec, err := session.NewCodec([]string{oldKey}, encrypt)
+		require.NoError(t, err)
+
+		token, err := codec.Encode("some_user")
+		require.NoError(t, err)
+		require.Equal(t, !encrypt, strings.Contains(token, "c29tZV91c2Vy"))
+
+		userID, stale, err := codec.Decode(token)
+		require.NoError(t, err)
+		require.False(t, stale)
+		require.Equal(t, "some_user", userID)
+
+		forged := []byte(token)
+		forged[5] ^= 1
+		_, _, err = codec.Decode(string(forged))
+		require.ErrorIs(t, err, session.ErrInvalidToken)
+
+		_, _, err = codec.Decode("some_user")
+		require.ErrorIs(t, err, session.ErrInvalidToken)
+
+		rotated, err := session.NewCodec([]string{newKey, oldKey}, encrypt)
+		require.NoError(t, err)
+
+		userID, stale, err = rotated.Decode(token)
+		require.NoError(t, err)
+		require.True(t, stale)
+		require.Equal(t, "some_user", userID)
+
+		dropped, err := session.NewCodec([]string{newKey}, encrypt)
+		require.NoError(t, err)
+
+		_, _, err = dropped.Decode(token)
+		require.ErrorIs(t, err, session.ErrInvalidToken)
+	}
+
+	_, err := session.NewCodec([]string{"short"}, false)
+	require.ErrorIs(t, err, session.ErrShortKey)
+}
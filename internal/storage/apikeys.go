@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// storedAPIKey is an API key kept by V1 under its hash.
+type storedAPIKey struct {
+	APIKey
+
+	UserUUID string `json:"user"`
+}
+
+func (s *V1) CreateAPIKey(ctx context.Context, userUUID string, key APIKey, keyHash string) error {
+	s.apiKeysMux.Lock()
+	defer s.apiKeysMux.Unlock()
+
+	createdAt := key.CreatedAt.UTC()
+	err := s.wal.append(walRecord{
+		Op:        walOpKeyCreate,
+		UserUUID:  userUUID,
+		KeyID:     key.ID,
+		KeyName:   key.Name,
+		KeyHash:   keyHash,
+		CreatedAt: &createdAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.apiKeys[keyHash] = &storedAPIKey{APIKey: key, UserUUID: userUUID}
+
+	return nil
+}
+
+func (s *V1) GetAPIKeys(ctx context.Context, userUUID string) ([]APIKey, error) {
+	s.apiKeysMux.RLock()
+	defer s.apiKeysMux.RUnlock()
+
+	res := make([]APIKey, 0)
+	for _, key := range s.apiKeys {
+		if key.UserUUID == userUUID {
+			res = append(res, key.APIKey)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreatedAt.Before(res[j].CreatedAt)
+	})
+
+	return res, nil
+}
+
+func (s *V1) RevokeAPIKey(ctx context.Context, userUUID string, keyID string) error {
+	s.apiKeysMux.Lock()
+	defer s.apiKeysMux.Unlock()
+
+	for keyHash, key := range s.apiKeys {
+		if key.UserUUID != userUUID || key.ID != keyID {
+			continue
+		}
+
+		err := s.wal.append(walRecord{Op: walOpKeyRevoke, UserUUID: userUUID, KeyHash: keyHash})
+		if err != nil {
+			return err
+		}
+
+		delete(s.apiKeys, keyHash)
+
+		return nil
+	}
+
+	return ErrValueNotFound
+}
+
+func (s *V1) GetAPIKeyUser(ctx context.Context, keyHash string) (string, error) {
+	s.apiKeysMux.RLock()
+	defer s.apiKeysMux.RUnlock()
+
+	key, ok := s.apiKeys[keyHash]
+	if !ok {
+		return "", ErrValueNotFound
+	}
+
+	return key.UserUUID, nil
+}
+
+func (s *V2) CreateAPIKey(ctx context.Context, userUUID string, key APIKey, keyHash string) error {
+	sql := "INSERT INTO apiKeys (id, userUUID, name, keyHash, createdAt) " +
+		"VALUES ($1, $2, $3, $4, $5);"
+	_, err := s.dbPool.Exec(ctx, sql, key.ID, userUUID, key.Name, keyHash, key.CreatedAt)
+
+	return err
+}
+
+func (s *V2) GetAPIKeys(ctx context.Context, userUUID string) ([]APIKey, error) {
+	sql := "SELECT id, name, createdAt FROM apiKeys WHERE userUUID=$1 ORDER BY createdAt;"
+	rows, err := s.dbPool.Query(ctx, sql, userUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	res := make([]APIKey, 0)
+	for rows.Next() {
+		key := APIKey{}
+		if err = rows.Scan(&key.ID, &key.Name, &key.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		res = append(res, key)
+	}
+
+	return res, rows.Err()
+}
+
+func (s *V2) RevokeAPIKey(ctx context.Context, userUUID string, keyID string) error {
+	sql := "DELETE FROM apiKeys WHERE userUUID=$1 AND id=$2;"
+	tag, err := s.dbPool.Exec(ctx, sql, userUUID, keyID)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrValueNotFound
+	}
+
+	return nil
+}
+
+func (s *V2) GetAPIKeyUser(ctx context.Context, keyHash string) (string, error) {
+	userUUID := ""
+
+	sql := "SELECT userUUID FROM apiKeys WHERE keyHash=$1;"
+	err := s.dbPool.QueryRow(ctx, sql, keyHash).Scan(&userUUID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrValueNotFound
+	}
+
+	return userUUID, err
+}
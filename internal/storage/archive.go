@@ -0,0 +1,392 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArchiveSort is the order of the links returned by GetUserArchive.
+type ArchiveSort string
+
+const (
+	ArchiveSortCreated ArchiveSort = "created_at"
+	ArchiveSortClicks  ArchiveSort = "clicks"
+)
+
+var ErrUnknownArchiveSort = errors.New("unknown archive sort")
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ParseArchiveSort parses the sort name, empty means ArchiveSortCreated.
+func ParseArchiveSort(value string) (ArchiveSort, error) {
+	switch archiveSort := ArchiveSort(value); archiveSort {
+	case "":
+		return ArchiveSortCreated, nil
+	case ArchiveSortCreated, ArchiveSortClicks:
+		return archiveSort, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownArchiveSort, value)
+	}
+}
+
+// ArchiveOptions select the links returned by GetUserArchive.
+type ArchiveOptions struct {
+	// IncludeDeleted adds the links deleted by the user which are not purged
+	// yet.
+	IncludeDeleted bool
+
+	// Sort orders the links, the newest or the most clicked first unless
+	// Ascending is set. The ties are ordered by the short URL id.
+	Sort      ArchiveSort
+	Ascending bool
+
+	// Query keeps the links whose original URL contains it, ignoring case.
+	Query string
+	// Domain keeps the links to the domain and its subdomains.
+	Domain string
+	// Tag keeps the links having the tag.
+	Tag string
+	// Folder keeps the links in the folder.
+	Folder string
+
+	// Limit is the page size, 0 returns all the links.
+	Limit int
+	// Cursor is the NextCursor of the previous page.
+	Cursor string
+}
+
+// ArchivePage is a page of the user links, NextCursor is empty on the last
+// one.
+type ArchivePage struct {
+	URLs       []UserUrls `json:"urls"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// archiveCursor points at the last link of a page. Key is the value of the
+// sort field, the creation time in microseconds or the amount of clicks.
+type archiveCursor struct {
+	Sort         ArchiveSort
+	Ascending    bool
+	Key          int64
+	ShortenURLId string
+}
+
+func (c archiveCursor) String() string {
+	order := "desc"
+	if c.Ascending {
+		order = "asc"
+	}
+
+	value := fmt.Sprintf("%s:%s:%d:%s", c.Sort, order, c.Key, c.ShortenURLId)
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+// parseArchiveCursor decodes the cursor checking it was made for the same
+// order, nil is returned for the empty one.
+func parseArchiveCursor(value string, opts ArchiveOptions) (*archiveCursor, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	parts := strings.SplitN(string(data), ":", 4)
+	if len(parts) != 4 {
+		return nil, ErrInvalidCursor
+	}
+
+	cursor := &archiveCursor{
+		Sort:         ArchiveSort(parts[0]),
+		Ascending:    parts[1] == "asc",
+		ShortenURLId: parts[3],
+	}
+
+	if cursor.Key, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	if cursor.Sort != opts.Sort || cursor.Ascending != opts.Ascending {
+		return nil, ErrInvalidCursor
+	}
+
+	return cursor, nil
+}
+
+// archiveEntry is a user link along with the value it is sorted by.
+type archiveEntry struct {
+	UserUrls
+
+	key          int64
+	shortenURLId string
+}
+
+// archiveLess reports whether the link a goes before the link b in the
+// requested order.
+func archiveLess(aKey int64, aID string, bKey int64, bID string, ascending bool) bool {
+	if aKey == bKey {
+		if ascending {
+			return aID < bID
+		}
+
+		return aID > bID
+	}
+
+	if ascending {
+		return aKey < bKey
+	}
+
+	return aKey > bKey
+}
+
+// newArchivePage makes a page of the sorted entries, one entry more than the
+// limit means there is a next page.
+func newArchivePage(entries []archiveEntry, opts ArchiveOptions) *ArchivePage {
+	page := &ArchivePage{URLs: make([]UserUrls, 0, len(entries))}
+
+	if opts.Limit > 0 && len(entries) > opts.Limit {
+		entries = entries[:opts.Limit]
+
+		last := entries[len(entries)-1]
+		page.NextCursor = archiveCursor{
+			Sort:         opts.Sort,
+			Ascending:    opts.Ascending,
+			Key:          last.key,
+			ShortenURLId: last.shortenURLId,
+		}.String()
+	}
+
+	for _, entry := range entries {
+		page.URLs = append(page.URLs, entry.UserUrls)
+	}
+
+	return page
+}
+
+// urlHost returns the lowercased host of the URL, empty if it is not parsed.
+func urlHost(originalURL string) string {
+	parsed, err := url.Parse(originalURL)
+	if err != nil {
+		return ""
+	}
+
+	return strings.ToLower(parsed.Hostname())
+}
+
+func matchesDomain(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func containsString(values []string, value string) bool {
+	for _, iterValue := range values {
+		if iterValue == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *V1) GetUserArchive(ctx context.Context, userUUID string, opts ArchiveOptions) (*ArchivePage, error) {
+	cursor, err := parseArchiveCursor(opts.Cursor, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	query, domain := strings.ToLower(opts.Query), strings.ToLower(opts.Domain)
+
+	s.dbMux.RLock()
+	defer s.dbMux.RUnlock()
+
+	s.usersArcMux.RLock()
+	defer s.usersArcMux.RUnlock()
+
+	s.clicksMux.Lock()
+	defer s.clicksMux.Unlock()
+
+	urls, ok := s.usersArchive[userUUID]
+	if !ok {
+		return nil, ErrValueNotFound
+	}
+
+	entries := make([]archiveEntry, 0, len(urls))
+
+	now := time.Now()
+	for shortenURLId, isPresent := range urls {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if s.isExpired(shortenURLId, now) || !isPresent && !opts.IncludeDeleted {
+			continue
+		}
+
+		originalURL := s.db[shortenURLId]
+		if query != "" && !strings.Contains(strings.ToLower(originalURL), query) {
+			continue
+		}
+
+		if domain != "" && !matchesDomain(urlHost(originalURL), domain) {
+			continue
+		}
+
+		entry := archiveEntry{
+			UserUrls: UserUrls{
+				ShortURL:    s.baseURL + "/" + shortenURLId,
+				OriginalURL: originalURL,
+			},
+			shortenURLId: shortenURLId,
+		}
+
+		if labels, ok := s.labels[userUUID][shortenURLId]; ok {
+			entry.Tags, entry.Folder = labels.tagList(), labels.Folder
+		}
+
+		if opts.Tag != "" && !containsString(entry.Tags, opts.Tag) || opts.Folder != "" && entry.Folder != opts.Folder {
+			continue
+		}
+
+		if meta, ok := s.meta[shortenURLId]; ok {
+			entry.Title, entry.Description, entry.Preview = meta.Title, meta.Description, meta.Preview
+			entry.CreatedAt, entry.CreatedBy, entry.UpdatedAt = meta.CreatedAt, meta.CreatedBy, meta.UpdatedAt
+		}
+
+		if clicks, ok := s.clicks[shortenURLId]; ok {
+			entry.Clicks = clicks.Total
+		}
+
+		if !isPresent {
+			deletedAt := s.deleted[userUUID][shortenURLId]
+			entry.DeletedAt = &deletedAt
+		}
+
+		if opts.Sort == ArchiveSortClicks {
+			entry.key = int64(entry.Clicks)
+		} else {
+			entry.key = entry.CreatedAt.UnixMicro()
+		}
+
+		if cursor != nil && !archiveLess(cursor.Key, cursor.ShortenURLId, entry.key, entry.shortenURLId, opts.Ascending) {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return archiveLess(entries[i].key, entries[i].shortenURLId, entries[j].key, entries[j].shortenURLId, opts.Ascending)
+	})
+
+	return newArchivePage(entries, opts), nil
+}
+
+// v2ArchiveHost extracts the host of the original URL the same way as urlHost.
+const v2ArchiveHost = "lower(substring(s.originalURL from '^[a-zA-Z][a-zA-Z0-9+.-]*://(?:[^@/?#]*@)?([^:/?#]+)'))"
+
+// GetUserArchive selects a page of the user links with a single query, the
+// clicks are counted for every link of the user.
+func (s *V2) GetUserArchive(ctx context.Context, userUUID string, opts ArchiveOptions) (*ArchivePage, error) {
+	cursor, err := parseArchiveCursor(opts.Cursor, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []interface{}{userUUID, opts.IncludeDeleted}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	conditions := []string{"TRUE"}
+	if opts.Query != "" {
+		conditions = append(conditions, "strpos(lower(originalURL), lower("+arg(opts.Query)+")) > 0")
+	}
+
+	if opts.Domain != "" {
+		domain := arg(strings.ToLower(opts.Domain))
+		conditions = append(conditions, "(host = "+domain+" OR right(host, length("+domain+") + 1) = '.' || "+domain+")")
+	}
+
+	if opts.Tag != "" {
+		conditions = append(conditions, arg(opts.Tag)+" = ANY(tags)")
+	}
+
+	if opts.Folder != "" {
+		conditions = append(conditions, "folder = "+arg(opts.Folder))
+	}
+
+	sortField, order, compare := "createdAt", "DESC", "<"
+	if opts.Sort == ArchiveSortClicks {
+		sortField = "clicks"
+	}
+
+	if opts.Ascending {
+		order, compare = "ASC", ">"
+	}
+
+	if cursor != nil {
+		var key interface{} = cursor.Key
+		if opts.Sort != ArchiveSortClicks {
+			key = time.UnixMicro(cursor.Key)
+		}
+
+		conditions = append(conditions, fmt.Sprintf("(%s, shortenURLId) %s (%s, %s)", sortField, compare, arg(key), arg(cursor.ShortenURLId)))
+	}
+
+	limit := "ALL"
+	if opts.Limit > 0 {
+		limit = arg(opts.Limit + 1)
+	}
+
+	sql := "SELECT shortenURLId, originalURL, title, description, preview, clicks, tags, folder, deletedAt, createdAt, createdBy, updatedAt FROM (" +
+		"SELECT u.shortenURLId, s.originalURL, s.title, s.description, s.preview, u.folder, u.deletedAt, s.createdAt, s.createdBy, s.updatedAt, " +
+		v2ArchiveHost + " AS host, " +
+		"ARRAY(SELECT t.tag FROM linkTags t WHERE t.userUUID = u.userUUID AND t.shortenURLId = u.shortenURLId ORDER BY t.tag) AS tags, " +
+		"(SELECT count(*) FROM clicks c WHERE c.shortenURLId = u.shortenURLId) AS clicks " +
+		"FROM usersArchive u JOIN shortensArchive s ON s.shortenURLId = u.shortenURLId " +
+		"WHERE u.userUUID=$1 AND (u.isPresent OR $2) AND (s.expiresAt IS NULL OR s.expiresAt > now())" +
+		") links WHERE " + strings.Join(conditions, " AND ") +
+		fmt.Sprintf(" ORDER BY %s %s, shortenURLId %s LIMIT %s;", sortField, order, order, limit)
+
+	rows, err := s.dbPool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	entries := make([]archiveEntry, 0)
+	for rows.Next() {
+		entry := archiveEntry{}
+		err = rows.Scan(
+			&entry.shortenURLId, &entry.OriginalURL, &entry.Title, &entry.Description, &entry.Preview, &entry.Clicks,
+			&entry.Tags, &entry.Folder, &entry.DeletedAt, &entry.CreatedAt, &entry.CreatedBy, &entry.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		entry.ShortURL = s.baseURL + "/" + entry.shortenURLId
+		if opts.Sort == ArchiveSortClicks {
+			entry.key = int64(entry.Clicks)
+		} else {
+			entry.key = entry.CreatedAt.UnixMicro()
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return newArchivePage(entries, opts), nil
+}
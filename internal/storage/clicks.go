@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Amount of referrers returned in LinkStats.
+const topReferrersLimit = 10
+
+const statsDateLayout = "2006-01-02"
+
+type Click struct {
+	ShortURLId string
+	Time       time.Time
+	Referrer   string
+	UserAgent  string
+	IPHash     string
+}
+
+type DailyClicks struct {
+	Date   string `json:"date"`
+	Clicks int    `json:"clicks"`
+}
+
+type ReferrerClicks struct {
+	Referrer string `json:"referrer"`
+	Clicks   int    `json:"clicks"`
+}
+
+type LinkStats struct {
+	Total          int              `json:"total"`
+	UniqueVisitors int              `json:"unique_visitors"`
+	Daily          []DailyClicks    `json:"daily"`
+	TopReferrers   []ReferrerClicks `json:"top_referrers"`
+}
+
+// linkClicks are the clicks of a link aggregated by V1.
+type linkClicks struct {
+	Total     int             `json:"total"`
+	Daily     map[string]int  `json:"daily"`
+	Referrers map[string]int  `json:"referrers"`
+	Visitors  map[string]bool `json:"visitors"`
+}
+
+func newLinkClicks() *linkClicks {
+	return &linkClicks{
+		Daily:     make(map[string]int),
+		Referrers: make(map[string]int),
+		Visitors:  make(map[string]bool),
+	}
+}
+
+func (c *linkClicks) add(click Click) {
+	c.Total++
+	c.Daily[click.Time.UTC().Format(statsDateLayout)]++
+
+	if click.Referrer != "" {
+		c.Referrers[click.Referrer]++
+	}
+
+	if click.IPHash != "" {
+		c.Visitors[click.IPHash] = true
+	}
+}
+
+func (c *linkClicks) stats() *LinkStats {
+	res := &LinkStats{
+		Total:          c.Total,
+		UniqueVisitors: len(c.Visitors),
+		Daily:          make([]DailyClicks, 0, len(c.Daily)),
+		TopReferrers:   make([]ReferrerClicks, 0, len(c.Referrers)),
+	}
+
+	for date, clicks := range c.Daily {
+		res.Daily = append(res.Daily, DailyClicks{Date: date, Clicks: clicks})
+	}
+
+	sort.Slice(res.Daily, func(i, j int) bool {
+		return res.Daily[i].Date < res.Daily[j].Date
+	})
+
+	for referrer, clicks := range c.Referrers {
+		res.TopReferrers = append(res.TopReferrers, ReferrerClicks{Referrer: referrer, Clicks: clicks})
+	}
+
+	sort.Slice(res.TopReferrers, func(i, j int) bool {
+		a, b := res.TopReferrers[i], res.TopReferrers[j]
+		return a.Clicks > b.Clicks || (a.Clicks == b.Clicks && a.Referrer < b.Referrer)
+	})
+
+	if len(res.TopReferrers) > topReferrersLimit {
+		res.TopReferrers = res.TopReferrers[:topReferrersLimit]
+	}
+
+	return res
+}
+
+func (s *V1) RecordClicks(ctx context.Context, clicks []Click) error {
+	// The link can not be purged until its clicks are recorded.
+	s.dbMux.RLock()
+
+	// The clicks of the unknown or already purged links are dropped.
+	known := make([]Click, 0, len(clicks))
+	for _, click := range clicks {
+		if _, ok := s.db[click.ShortURLId]; ok {
+			known = append(known, click)
+		}
+	}
+
+	records := make([]walRecord, len(known))
+	for i, click := range known {
+		clickTime := click.Time.UTC()
+		records[i] = walRecord{
+			Op:         walOpClick,
+			ShortURLId: click.ShortURLId,
+			ClickedAt:  &clickTime,
+			Referrer:   click.Referrer,
+			UserAgent:  click.UserAgent,
+			IPHash:     click.IPHash,
+		}
+	}
+
+	s.clicksMux.Lock()
+
+	var err error
+	if len(records) > 0 {
+		err = s.wal.append(records...)
+	}
+	if err == nil {
+		for _, click := range known {
+			s.addClick(click)
+		}
+	}
+
+	s.clicksMux.Unlock()
+	s.dbMux.RUnlock()
+
+	s.compactIfNeeded()
+
+	return err
+}
+
+// addClick must be called with clicksMux locked.
+func (s *V1) addClick(click Click) {
+	if s.clicks[click.ShortURLId] == nil {
+		s.clicks[click.ShortURLId] = newLinkClicks()
+	}
+
+	s.clicks[click.ShortURLId].add(click)
+}
+
+func (s *V1) GetLinkStats(ctx context.Context, shortURLId string, userUUID string) (*LinkStats, error) {
+	s.usersArcMux.RLock()
+	_, isOwner := s.usersArchive[userUUID][shortURLId]
+	s.usersArcMux.RUnlock()
+
+	if !isOwner {
+		return nil, ErrValueNotFound
+	}
+
+	s.clicksMux.Lock()
+	defer s.clicksMux.Unlock()
+
+	if s.clicks[shortURLId] == nil {
+		return newLinkClicks().stats(), nil
+	}
+
+	return s.clicks[shortURLId].stats(), nil
+}
+
+func (s *V2) RecordClicks(ctx context.Context, clicks []Click) error {
+	rows := make([][]interface{}, len(clicks))
+	for i, click := range clicks {
+		rows[i] = []interface{}{click.ShortURLId, click.Time, click.Referrer, click.UserAgent, click.IPHash}
+	}
+
+	columns := []string{"shortenurlid", "clickedat", "referrer", "useragent", "iphash"}
+	_, err := s.dbPool.CopyFrom(ctx, pgx.Identifier{"clicks"}, columns, pgx.CopyFromRows(rows))
+
+	return err
+}
+
+func (s *V2) GetLinkStats(ctx context.Context, shortURLId string, userUUID string) (*LinkStats, error) {
+	isOwner := false
+	sql := "SELECT EXISTS (SELECT 1 FROM usersArchive WHERE userUUID=$1 AND shortenURLId=$2);"
+	err := s.dbPool.QueryRow(ctx, sql, userUUID, shortURLId).Scan(&isOwner)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isOwner {
+		return nil, ErrValueNotFound
+	}
+
+	res := &LinkStats{
+		Daily:        make([]DailyClicks, 0),
+		TopReferrers: make([]ReferrerClicks, 0),
+	}
+
+	sql = "SELECT COUNT(*), COUNT(DISTINCT NULLIF(ipHash, '')) FROM clicks WHERE shortenURLId=$1;"
+	err = s.dbPool.QueryRow(ctx, sql, shortURLId).Scan(&res.Total, &res.UniqueVisitors)
+	if err != nil {
+		return nil, err
+	}
+
+	sql = "SELECT to_char(clickedAt AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, COUNT(*) " +
+		"FROM clicks WHERE shortenURLId=$1 " +
+		"GROUP BY day ORDER BY day;"
+	rows, err := s.dbPool.Query(ctx, sql, shortURLId)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		daily := DailyClicks{}
+		if err = rows.Scan(&daily.Date, &daily.Clicks); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		res.Daily = append(res.Daily, daily)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sql = "SELECT referrer, COUNT(*) AS clicksCount " +
+		"FROM clicks WHERE shortenURLId=$1 AND referrer <> '' " +
+		"GROUP BY referrer ORDER BY clicksCount DESC, referrer LIMIT $2;"
+	rows, err = s.dbPool.Query(ctx, sql, shortURLId, topReferrersLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		referrer := ReferrerClicks{}
+		if err = rows.Scan(&referrer.Referrer, &referrer.Clicks); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		res.TopReferrers = append(res.TopReferrers, referrer)
+	}
+
+	return res, rows.Err()
+}
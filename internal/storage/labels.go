@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// linkLabels are the tags and the folder a user gave to a link.
+type linkLabels struct {
+	Tags   setStringType `json:"tags,omitempty"`
+	Folder string        `json:"folder,omitempty"`
+}
+
+// userLabels holds the labels of the user links by the short URL id.
+type userLabels map[string]*linkLabels
+
+func (l *linkLabels) tagList() []string {
+	res := make([]string, 0, len(l.Tags))
+	for tag := range l.Tags {
+		res = append(res, tag)
+	}
+
+	sort.Strings(res)
+
+	return res
+}
+
+// linkLabels returns the labels of the user link creating them when missing,
+// it must be called with usersArcMux locked.
+func (s *V1) linkLabels(userUUID, shortenURLId string) *linkLabels {
+	if s.labels[userUUID] == nil {
+		s.labels[userUUID] = make(userLabels)
+	}
+
+	labels, ok := s.labels[userUUID][shortenURLId]
+	if !ok {
+		labels = &linkLabels{Tags: make(setStringType)}
+		s.labels[userUUID][shortenURLId] = labels
+	}
+
+	if labels.Tags == nil {
+		labels.Tags = make(setStringType)
+	}
+
+	return labels
+}
+
+func (s *V1) addTags(userUUID, shortenURLId string, tags []string) {
+	labels := s.linkLabels(userUUID, shortenURLId)
+	for _, tag := range tags {
+		labels.Tags[tag] = true
+	}
+}
+
+func (s *V1) removeTags(userUUID, shortenURLId string, tags []string) {
+	labels := s.linkLabels(userUUID, shortenURLId)
+	for _, tag := range tags {
+		delete(labels.Tags, tag)
+	}
+}
+
+func (s *V1) moveToFolder(userUUID, shortenURLId, folder string) {
+	s.linkLabels(userUUID, shortenURLId).Folder = folder
+}
+
+// changeLabels applies the change to the labels of the link owned by the user
+// once it is logged, the resulting tags are returned.
+func (s *V1) changeLabels(ctx context.Context, record walRecord, change func()) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.dbMux.Lock()
+	s.usersArcMux.Lock()
+
+	if _, ok := s.usersArchive[record.UserUUID][record.ShortURLId]; !ok {
+		s.usersArcMux.Unlock()
+		s.dbMux.Unlock()
+		return nil, ErrValueNotFound
+	}
+
+	updatedAt := time.Now().UTC()
+	record.UpdatedAt = &updatedAt
+
+	if err := s.wal.append(record); err != nil {
+		s.usersArcMux.Unlock()
+		s.dbMux.Unlock()
+		return nil, err
+	}
+
+	change()
+	s.touch(record.ShortURLId, updatedAt)
+	tags := s.linkLabels(record.UserUUID, record.ShortURLId).tagList()
+
+	s.usersArcMux.Unlock()
+	s.dbMux.Unlock()
+
+	s.compactIfNeeded()
+
+	return tags, nil
+}
+
+func (s *V1) AddTags(ctx context.Context, shortenURLId string, userUUID string, tags []string) ([]string, error) {
+	record := walRecord{Op: walOpTag, ShortURLId: shortenURLId, UserUUID: userUUID, Tags: tags}
+	return s.changeLabels(ctx, record, func() {
+		s.addTags(userUUID, shortenURLId, tags)
+	})
+}
+
+func (s *V1) RemoveTags(ctx context.Context, shortenURLId string, userUUID string, tags []string) ([]string, error) {
+	record := walRecord{Op: walOpUntag, ShortURLId: shortenURLId, UserUUID: userUUID, Tags: tags}
+	return s.changeLabels(ctx, record, func() {
+		s.removeTags(userUUID, shortenURLId, tags)
+	})
+}
+
+func (s *V1) MoveToFolder(ctx context.Context, shortenURLId string, userUUID string, folder string) error {
+	record := walRecord{Op: walOpMove, ShortURLId: shortenURLId, UserUUID: userUUID, Folder: folder}
+	_, err := s.changeLabels(ctx, record, func() {
+		s.moveToFolder(userUUID, shortenURLId, folder)
+	})
+
+	return err
+}
+
+// checkOwner checks the link belongs to the user within the transaction.
+func checkOwner(ctx context.Context, tx pgx.Tx, shortenURLId, userUUID string) error {
+	sql := "SELECT 1 FROM usersArchive WHERE userUUID=$1 AND shortenURLId=$2;"
+	err := tx.QueryRow(ctx, sql, userUUID, shortenURLId).Scan(new(int))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrValueNotFound
+	}
+
+	return err
+}
+
+// touchLink moves the update moment of the link within the transaction.
+func touchLink(ctx context.Context, tx pgx.Tx, shortenURLId string) error {
+	_, err := tx.Exec(ctx, "UPDATE shortensArchive SET updatedAt=now() WHERE shortenURLId=$1;", shortenURLId)
+	return err
+}
+
+// changeTags runs the statement over the tags of the link owned by the user
+// and returns the resulting tags.
+func (s *V2) changeTags(ctx context.Context, sql string, shortenURLId string, userUUID string, tags []string) ([]string, error) {
+	tx, err := s.dbPool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	if err = checkOwner(ctx, tx, shortenURLId, userUUID); err != nil {
+		return nil, err
+	}
+
+	if _, err = tx.Exec(ctx, sql, userUUID, shortenURLId, tags); err != nil {
+		return nil, err
+	}
+
+	if err = touchLink(ctx, tx, shortenURLId); err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0)
+	sql = "SELECT tag FROM linkTags WHERE userUUID=$1 AND shortenURLId=$2 ORDER BY tag;"
+	rows, err := tx.Query(ctx, sql, userUUID, shortenURLId)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		tag := ""
+		if err = rows.Scan(&tag); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		res = append(res, tag)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, tx.Commit(ctx)
+}
+
+func (s *V2) AddTags(ctx context.Context, shortenURLId string, userUUID string, tags []string) ([]string, error) {
+	sql := "INSERT INTO linkTags (userUUID, shortenURLId, tag) " +
+		"SELECT $1, $2, unnest($3::text[]) ON CONFLICT DO NOTHING;"
+	return s.changeTags(ctx, sql, shortenURLId, userUUID, tags)
+}
+
+func (s *V2) RemoveTags(ctx context.Context, shortenURLId string, userUUID string, tags []string) ([]string, error) {
+	sql := "DELETE FROM linkTags WHERE userUUID=$1 AND shortenURLId=$2 AND tag = ANY($3);"
+	return s.changeTags(ctx, sql, shortenURLId, userUUID, tags)
+}
+
+func (s *V2) MoveToFolder(ctx context.Context, shortenURLId string, userUUID string, folder string) error {
+	sql := "WITH moved AS (" +
+		"UPDATE usersArchive SET folder=$3 WHERE userUUID=$1 AND shortenURLId=$2 RETURNING shortenURLId) " +
+		"UPDATE shortensArchive SET updatedAt=now() WHERE shortenURLId IN (SELECT shortenURLId FROM moved);"
+	tag, err := s.dbPool.Exec(ctx, sql, userUUID, shortenURLId, folder)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrValueNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// LinkInfo is the public information of a link shown on its preview page, it
+// is looked up the same way as GetOriginalURL does.
+type LinkInfo struct {
+	ShortURL    string
+	OriginalURL string
+	Title       string
+	Description string
+	CreatedAt   time.Time
+	Preview     bool
+}
+
+func (s *V1) GetLinkInfo(ctx context.Context, shortenURLId string, userUUID string) (*LinkInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if userUUID != "" {
+		s.usersArcMux.RLock()
+		isPresent := s.usersArchive[userUUID][shortenURLId]
+		s.usersArcMux.RUnlock()
+
+		if !isPresent {
+			return nil, ErrValueGone
+		}
+	}
+
+	s.dbMux.RLock()
+	defer s.dbMux.RUnlock()
+
+	originalURL, ok := s.db[shortenURLId]
+	if !ok {
+		return nil, ErrValueNotFound
+	}
+
+	if s.isExpired(shortenURLId, time.Now()) {
+		return nil, ErrValueGone
+	}
+
+	info := &LinkInfo{
+		ShortURL:    s.baseURL + "/" + shortenURLId,
+		OriginalURL: originalURL,
+	}
+
+	if meta, ok := s.meta[shortenURLId]; ok {
+		info.Title, info.Description, info.CreatedAt, info.Preview = meta.Title, meta.Description, meta.CreatedAt, meta.Preview
+	}
+
+	return info, nil
+}
+
+func (s *V2) GetLinkInfo(ctx context.Context, shortenURLId string, userUUID string) (*LinkInfo, error) {
+	info := &LinkInfo{ShortURL: s.baseURL + "/" + shortenURLId}
+	var expiresAt *time.Time
+	var isPresent *bool
+
+	// The link of the user is checked by the same query.
+	sql := "SELECT s.originalURL, s.title, s.description, s.createdAt, s.preview, s.expiresAt, u.isPresent " +
+		"FROM shortensArchive s LEFT JOIN usersArchive u ON u.shortenURLId = s.shortenURLId AND u.userUUID = $2 " +
+		"WHERE s.shortenURLId=$1;"
+	err := s.dbPool.QueryRow(ctx, sql, shortenURLId, userUUID).Scan(
+		&info.OriginalURL, &info.Title, &info.Description, &info.CreatedAt, &info.Preview, &expiresAt, &isPresent,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrValueNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if userUUID != "" {
+		if isPresent == nil {
+			return nil, ErrValueNotFound
+		} else if !*isPresent {
+			return nil, ErrValueGone
+		}
+	}
+
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, ErrValueGone
+	}
+
+	return info, nil
+}
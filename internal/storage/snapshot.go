@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Version of the V1 snapshot file format written by the current code.
+//
+// Version 1 is the legacy flat `{"shortenURLId": "originalURL"}` map without
+// any version field. Version 2 carries the users ownership and deletion state
+// alongside the links.
+const snapshotVersion = 2
+
+type snapshot struct {
+	Version    int                      `json:"version"`
+	Seq        uint64                   `json:"seq"`
+	AppliedLSN uint64                   `json:"applied_lsn,omitempty"`
+	Links      map[string]string        `json:"links"`
+	Expires    map[string]time.Time     `json:"expires,omitempty"`
+	Meta       map[string]*linkMeta     `json:"meta,omitempty"`
+	Users      map[string]setStringType `json:"users"`
+	Deleted    map[string]deletedSet    `json:"deleted,omitempty"`
+	Labels     map[string]userLabels    `json:"labels,omitempty"`
+	Clicks     map[string]*linkClicks   `json:"clicks,omitempty"`
+	APIKeys    map[string]*storedAPIKey `json:"api_keys,omitempty"`
+}
+
+var ErrUnknownSnapshotVersion = errors.New("unknown snapshot version")
+
+// snapshotMigrations[v] converts a snapshot of version v into version v+1.
+var snapshotMigrations = map[int]func(data []byte) ([]byte, error){
+	1: migrateSnapshotV1,
+}
+
+func migrateSnapshotV1(data []byte) ([]byte, error) {
+	links := make(map[string]string)
+	if err := json.Unmarshal(data, &links); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&snapshot{
+		Version: 2,
+		Seq:     uint64(len(links)),
+		Links:   links,
+		Users:   make(map[string]setStringType),
+	})
+}
+
+func snapshotDataVersion(data []byte) (int, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return 0, err
+	}
+
+	versionBytes, ok := fields["version"]
+	if !ok {
+		return 1, nil
+	}
+
+	version := 0
+	if err := json.Unmarshal(versionBytes, &version); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// readSnapshot reads the snapshot file migrating it to the current version.
+// A missing or empty file is an empty snapshot. The returned version is the
+// one found on disk.
+func readSnapshot(path string) (*snapshot, int, error) {
+	snap := &snapshot{
+		Version: snapshotVersion,
+		Links:   make(map[string]string),
+		Expires: make(map[string]time.Time),
+		Meta:    make(map[string]*linkMeta),
+		Users:   make(map[string]setStringType),
+		Deleted: make(map[string]deletedSet),
+		Labels:  make(map[string]userLabels),
+		Clicks:  make(map[string]*linkClicks),
+		APIKeys: make(map[string]*storedAPIKey),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && len(data) == 0) {
+		return snap, snapshotVersion, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	diskVersion, err := snapshotDataVersion(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if diskVersion > snapshotVersion {
+		return nil, 0, fmt.Errorf("%w: %d", ErrUnknownSnapshotVersion, diskVersion)
+	}
+
+	for version := diskVersion; version < snapshotVersion; version++ {
+		migrate, ok := snapshotMigrations[version]
+		if !ok {
+			return nil, 0, fmt.Errorf("%w: %d", ErrUnknownSnapshotVersion, version)
+		}
+
+		if data, err = migrate(data); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if err = json.Unmarshal(data, snap); err != nil {
+		return nil, 0, err
+	}
+
+	if snap.Links == nil {
+		snap.Links = make(map[string]string)
+	}
+	if snap.Expires == nil {
+		snap.Expires = make(map[string]time.Time)
+	}
+	if snap.Meta == nil {
+		snap.Meta = make(map[string]*linkMeta)
+	}
+	if snap.Users == nil {
+		snap.Users = make(map[string]setStringType)
+	}
+	if snap.Deleted == nil {
+		snap.Deleted = make(map[string]deletedSet)
+	}
+	if snap.Labels == nil {
+		snap.Labels = make(map[string]userLabels)
+	}
+	if snap.Clicks == nil {
+		snap.Clicks = make(map[string]*linkClicks)
+	}
+	if snap.APIKeys == nil {
+		snap.APIKeys = make(map[string]*storedAPIKey)
+	}
+
+	return snap, diskVersion, nil
+}
+
+func writeSnapshot(path string, snap *snapshot) error {
+	return writeFileSync(path, func(writer io.Writer) error {
+		return json.NewEncoder(writer).Encode(snap)
+	})
+}
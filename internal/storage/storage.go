@@ -2,15 +2,15 @@ package storage
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"os"
-	"strconv"
 	"sync"
+	"time"
 
-	"github.com/GermanVor/shortener-pet-project/internal/common"
+	"github.com/GermanVor/shortener-pet-project/internal/idgen"
+	"github.com/GermanVor/shortener-pet-project/internal/migrations"
+	"github.com/GermanVor/shortener-pet-project/internal/urlpolicy"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
@@ -18,56 +18,314 @@ import (
 type UserUrls struct {
 	ShortURL    string `json:"short_url"`
 	OriginalURL string `json:"original_url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Clicks      int    `json:"clicks"`
+
+	// Tags and Folder are given to the link by the user.
+	Tags   []string `json:"tags,omitempty"`
+	Folder string   `json:"folder,omitempty"`
+
+	// Preview shows the link preview page instead of redirecting.
+	Preview bool `json:"preview,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	// CreatedBy is the user who created the link first, empty if it was
+	// created anonymously.
+	CreatedBy string    `json:"created_by,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// DeletedAt is set for the links deleted by the user.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// ShortenOptions are optional parameters of a new short URL.
+type ShortenOptions struct {
+	// Alias is used as the short URL id instead of a generated one, the
+	// aliased link is created even if the URL was already shortened.
+	Alias string `json:"alias,omitempty"`
+
+	// ExpiresAt is the moment the short URL stops working.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// TTL is the short URL lifetime in seconds, an alternative to ExpiresAt.
+	TTL int64 `json:"ttl,omitempty"`
+
+	// Title and Description are shown in the links lists, they are kept by
+	// the link created first and ignored when it is reused.
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	// Preview shows the link preview page instead of redirecting, it is kept
+	// by the link created first as well.
+	Preview bool `json:"preview,omitempty"`
+}
+
+// Expiry returns the moment the short URL stops working, nil if it never
+// expires.
+func (o ShortenOptions) Expiry(now time.Time) *time.Time {
+	if o.ExpiresAt != nil {
+		expiresAt := o.ExpiresAt.UTC()
+		return &expiresAt
+	}
+
+	if o.TTL > 0 {
+		expiresAt := now.UTC().Add(time.Duration(o.TTL) * time.Second)
+		return &expiresAt
+	}
+
+	return nil
+}
+
+// DedupeScope tells which link ShortenURL returns for an already shortened
+// URL instead of making a new one.
+type DedupeScope string
+
+const (
+	// DedupeGlobal reuses the link of the URL whoever made it, it is the
+	// default keeping the 409 with the existing link for every client.
+	DedupeGlobal DedupeScope = "global"
+	// DedupeUser reuses only the links of the same user, so users own and
+	// delete their links independently. Anonymous links are not reused.
+	DedupeUser DedupeScope = "user"
+	// DedupeNone makes a new link every time.
+	DedupeNone DedupeScope = "none"
+)
+
+func ParseDedupeScope(value string) (DedupeScope, error) {
+	switch scope := DedupeScope(value); scope {
+	case DedupeGlobal, DedupeUser, DedupeNone:
+		return scope, nil
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrUnknownDedupeScope, value)
+}
+
+// key returns the key the links of originalURL are deduplicated by, false
+// when they are not. The key is made of the canonical form of the URL, so the
+// links stored before the URLs were normalized are deduplicated as well. V1
+// computes the keys on start, V2 rewrites the legacy keys in the global scope.
+func (d DedupeScope) key(originalURL, userUUID string) (string, bool) {
+	switch {
+	case d == DedupeGlobal:
+		return urlpolicy.Key(originalURL), true
+	case d == DedupeUser && userUUID != "":
+		return userUUID + " " + urlpolicy.Key(originalURL), true
+	}
+
+	return "", false
+}
+
+// linkKey returns the key a new link is deduplicated by. The aliased links
+// are never deduplicated, so the alias is created even for an already
+// shortened URL and the link shortened before keeps its key.
+func (d DedupeScope) linkKey(originalURL, userUUID string, opts ShortenOptions) (string, bool) {
+	if opts.Alias != "" {
+		return "", false
+	}
+
+	return d.key(originalURL, userUUID)
 }
 
 type MappingItem struct {
 	CorrelationID string `json:"correlation_id"`
 	OriginalURL   string `json:"original_url"`
+
+	ShortenOptions
 }
 
+// Interface is implemented by the storages. The methods give up with the
+// context error once ctx is done.
+//
+// ForEach calls the handler for every item in order with the result of
+// shortening it, the same one as ShortenURL returns.
+//
+// The tags and the folder are given by a user to their own link, AddTags and
+// RemoveTags return the resulting tags of the link. An empty folder moves the
+// link out of any folder.
 type Interface interface {
-	ShortenURL(originalURL string, userUUID string) (string, error)
-	GetOriginalURL(shortURLId string, userUUID string) (string, error)
-	GetUserArchive(userUUID string) ([]UserUrls, error)
-	ForEach(mapItem []MappingItem, userUUID string, handler func(correlationID string, shortURLId string) error) error
-	DeleteKeys(items []string, userUUID string) error
+	ShortenURL(ctx context.Context, originalURL string, userUUID string, opts ShortenOptions) (string, error)
+	GetOriginalURL(ctx context.Context, shortURLId string, userUUID string) (string, error)
+	GetLinkInfo(ctx context.Context, shortURLId string, userUUID string) (*LinkInfo, error)
+	GetUserArchive(ctx context.Context, userUUID string, opts ArchiveOptions) (*ArchivePage, error)
+	ForEach(ctx context.Context, mapItem []MappingItem, userUUID string, handler func(correlationID string, shortURL string, err error) error) error
+	DeleteKeys(ctx context.Context, items []string, userUUID string) error
+	RestoreKeys(ctx context.Context, items []string, userUUID string) ([]string, error)
+	PurgeExpired(ctx context.Context, now time.Time) (int, error)
+	PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error)
+	RecordClicks(ctx context.Context, clicks []Click) error
+	GetLinkStats(ctx context.Context, shortURLId string, userUUID string) (*LinkStats, error)
+
+	AddTags(ctx context.Context, shortURLId string, userUUID string, tags []string) ([]string, error)
+	RemoveTags(ctx context.Context, shortURLId string, userUUID string, tags []string) ([]string, error)
+	MoveToFolder(ctx context.Context, shortURLId string, userUUID string, folder string) error
+
+	CreateAPIKey(ctx context.Context, userUUID string, key APIKey, keyHash string) error
+	GetAPIKeys(ctx context.Context, userUUID string) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, userUUID string, keyID string) error
+	GetAPIKeyUser(ctx context.Context, keyHash string) (string, error)
 }
 
 var ErrValueNotFound = errors.New("value not found")
 var ErrValueGone = errors.New("value is gone")
 var ErrValueAlreadyShorted = errors.New("value not found")
+var ErrIDCollision = errors.New("could not generate a free short URL id")
+var ErrAliasTaken = errors.New("alias is already taken")
+var ErrUnknownDedupeScope = errors.New("unknown dedupe scope")
+
+// Amount of IDs tried before giving up with ErrIDCollision.
+const maxIDAttempts = 10
 
 type setStringType map[string]bool
 
+// deletedSet holds the moments the links were deleted by their owner.
+type deletedSet map[string]time.Time
+
+// linkMeta is the metadata of a link kept by V1.
+type linkMeta struct {
+	CreatedAt   time.Time `json:"created_at"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Preview     bool      `json:"preview,omitempty"`
+	// Alias links are not deduplicated.
+	Alias bool `json:"alias,omitempty"`
+}
+
+// V1 is the in-memory storage optionally persisted to a file. When several
+// mutexes are needed they are locked in the order dbMux, usersArcMux,
+// clicksMux, apiKeysMux.
 type V1 struct {
 	Interface
 
-	db     map[string]string
-	keysDB map[string]string
-	dbMux  sync.RWMutex
+	db map[string]string
+	// keysDB maps the dedupe keys to the short URL ids.
+	keysDB  map[string]string
+	expires map[string]time.Time
+	meta    map[string]*linkMeta
+	dbMux   sync.RWMutex
 
 	usersArchive map[string]setStringType
+	deleted      map[string]deletedSet
+	labels       map[string]userLabels
 	usersArcMux  sync.RWMutex
 
+	clicks    map[string]*linkClicks
+	clicksMux sync.Mutex
+
+	apiKeys    map[string]*storedAPIKey
+	apiKeysMux sync.RWMutex
+
+	idGen  idgen.Generator
+	seq    uint64
+	dedupe DedupeScope
+
 	baseURL         string
 	fileStoragePath string
+	wal             *wal
+}
+
+// newShortenURLId must be called with dbMux locked.
+func (s *V1) newShortenURLId() (string, error) {
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		s.seq++
+
+		shortenURLId, err := s.idGen.Generate(s.seq)
+		if err != nil {
+			return "", err
+		}
+
+		if _, ok := s.db[shortenURLId]; !ok {
+			return shortenURLId, nil
+		}
+	}
+
+	return "", ErrIDCollision
 }
 
-func (s *V1) ShortenURL(originalURL string, userUUID string) (string, error) {
+func (s *V1) ShortenURL(ctx context.Context, originalURL string, userUUID string, opts ShortenOptions) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
 	s.dbMux.Lock()
 
 	var alreadyShortedURLErr error
-	shortenURLId, isAlreadySaved := s.keysDB[originalURL]
+	var shortenURLId string
+	var isAlreadySaved bool
+
+	dedupeKey, isDeduped := s.dedupe.linkKey(originalURL, userUUID, opts)
+	if isDeduped {
+		shortenURLId, isAlreadySaved = s.keysDB[dedupeKey]
+	}
+
+	if isAlreadySaved && s.isExpired(shortenURLId, time.Now()) {
+		if err := s.purge([]string{shortenURLId}); err != nil {
+			s.dbMux.Unlock()
+			return "", err
+		}
+
+		isAlreadySaved = false
+	}
+
+	// The alias given again to the same URL is the existing link.
+	if opts.Alias != "" {
+		if aliasURL, ok := s.db[opts.Alias]; ok && aliasURL == originalURL && !s.isExpired(opts.Alias, time.Now()) {
+			shortenURLId, isAlreadySaved = opts.Alias, true
+		}
+	}
 
 	if !isAlreadySaved {
-		shortenURLId = strconv.Itoa(len(s.db) + 1)
+		expiresAt := opts.Expiry(time.Now())
 
-		s.keysDB[originalURL] = shortenURLId
-		s.db[shortenURLId] = originalURL
+		var err error
+		if opts.Alias != "" {
+			shortenURLId = opts.Alias
+			if _, ok := s.db[shortenURLId]; ok {
+				err = ErrAliasTaken
+			}
+		} else {
+			shortenURLId, err = s.newShortenURLId()
+		}
+
+		createdAt := time.Now().UTC()
+		if err == nil {
+			err = s.wal.append(walRecord{
+				Op:          walOpCreate,
+				ShortURLId:  shortenURLId,
+				OriginalURL: originalURL,
+				Seq:         s.seq,
+				UserUUID:    userUUID,
+				ExpiresAt:   expiresAt,
+				CreatedAt:   &createdAt,
+				Title:       opts.Title,
+				Description: opts.Description,
+				Preview:     opts.Preview,
+				Alias:       opts.Alias != "",
+			})
+		}
 
-		if s.fileStoragePath != "" {
-			backupBytes, _ := json.Marshal(&s.db)
-			os.WriteFile(s.fileStoragePath, backupBytes, 0644)
+		if err != nil {
+			s.dbMux.Unlock()
+			return "", err
+		}
+
+		if isDeduped {
+			s.keysDB[dedupeKey] = shortenURLId
+		}
+
+		s.db[shortenURLId] = originalURL
+		s.meta[shortenURLId] = &linkMeta{
+			CreatedAt:   createdAt,
+			CreatedBy:   userUUID,
+			UpdatedAt:   createdAt,
+			Title:       opts.Title,
+			Description: opts.Description,
+			Preview:     opts.Preview,
+			Alias:       opts.Alias != "",
+		}
+		if expiresAt != nil {
+			s.expires[shortenURLId] = *expiresAt
 		}
 	} else {
 		alreadyShortedURLErr = ErrValueAlreadyShorted
@@ -77,24 +335,32 @@ func (s *V1) ShortenURL(originalURL string, userUUID string) (string, error) {
 
 	if userUUID != "" {
 		s.usersArcMux.Lock()
-		defer s.usersArcMux.Unlock()
 
-		if s.usersArchive[userUUID] == nil {
-			s.usersArchive[userUUID] = make(setStringType)
+		if !s.usersArchive[userUUID][shortenURLId] {
+			err := s.wal.append(walRecord{Op: walOpOwn, ShortURLId: shortenURLId, UserUUID: userUUID})
+			if err != nil {
+				s.usersArcMux.Unlock()
+				return "", err
+			}
+
+			s.markOwned(userUUID, shortenURLId)
 		}
 
-		s.usersArchive[userUUID][shortenURLId] = true
+		s.usersArcMux.Unlock()
 	}
 
+	s.compactIfNeeded()
+
 	return s.baseURL + "/" + shortenURLId, alreadyShortedURLErr
 }
 
-func (s *V1) GetOriginalURL(shortenURLId string, userUUID string) (string, error) {
+func (s *V1) GetOriginalURL(ctx context.Context, shortenURLId string, userUUID string) (string, error) {
 	if userUUID != "" {
 		s.usersArcMux.RLock()
-		defer s.usersArcMux.RUnlock()
+		isPresent := s.usersArchive[userUUID][shortenURLId]
+		s.usersArcMux.RUnlock()
 
-		if s.usersArchive[userUUID] == nil || !s.usersArchive[userUUID][shortenURLId] {
+		if !isPresent {
 			return "", ErrValueGone
 		}
 	}
@@ -105,322 +371,1246 @@ func (s *V1) GetOriginalURL(shortenURLId string, userUUID string) (string, error
 	originalURL, ok := s.db[shortenURLId]
 
 	if ok {
+		if s.isExpired(shortenURLId, time.Now()) {
+			return "", ErrValueGone
+		}
+
 		return originalURL, nil
 	}
 
 	return "", ErrValueNotFound
 }
 
-func (s *V1) GetUserArchive(userUUID string) ([]UserUrls, error) {
-	s.usersArcMux.RLock()
-	defer s.usersArcMux.RUnlock()
-
-	urls, ok := s.usersArchive[userUUID]
-	if !ok {
-		return nil, ErrValueNotFound
-	}
-
-	res := make([]UserUrls, len(urls))
-
-	s.dbMux.RLock()
-	defer s.dbMux.RUnlock()
-
-	i := 0
-	for shortenURLId := range urls {
-		res[i] = UserUrls{
-			ShortURL:    s.baseURL + "/" + shortenURLId,
-			OriginalURL: s.db[shortenURLId],
+func (s *V1) ForEach(ctx context.Context, mapItem []MappingItem, userUUID string, handler func(CorrelationID string, ShortURL string, err error) error) error {
+	for _, iterItem := range mapItem {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
-		i++
-	}
-
-	return res, nil
-}
-
-func (s *V1) ForEach(mapItem []MappingItem, userUUID string, handler func(CorrelationID string, ShortURL string) error) error {
-	for _, iterItem := range mapItem {
-		shortURL, err := s.ShortenURL(iterItem.OriginalURL, userUUID)
-		if err == nil {
-			err = handler(iterItem.CorrelationID, shortURL)
-			if err != nil {
-				return err
-			}
+		shortURL, err := s.ShortenURL(ctx, iterItem.OriginalURL, userUUID, iterItem.ShortenOptions)
+		if err = handler(iterItem.CorrelationID, shortURL, err); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func (s *V1) DeleteKeys(items []string, userUUID string) error {
+func (s *V1) DeleteKeys(ctx context.Context, items []string, userUUID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.dbMux.Lock()
 	s.usersArcMux.Lock()
-	defer s.usersArcMux.Unlock()
 
 	if s.usersArchive[userUUID] == nil {
+		s.usersArcMux.Unlock()
+		s.dbMux.Unlock()
 		return nil
 	}
 
-	for _, shortURL := range items {
-		s.usersArchive[userUUID][shortURL] = false
-	}
+	deletedAt := time.Now().UTC()
 
-	return nil
-}
+	// The links of the other users are skipped.
+	owned := make([]string, 0, len(items))
+	records := make([]walRecord, 0, len(items))
+	for _, shortURL := range items {
+		if _, isOwned := s.usersArchive[userUUID][shortURL]; !isOwned {
+			continue
+		}
 
-func InitV1(baseURL, fileStoragePath string) *V1 {
-	s := &V1{
-		db:              make(map[string]string),
-		keysDB:          make(map[string]string),
-		usersArchive:    make(map[string]setStringType),
-		baseURL:         baseURL,
-		fileStoragePath: fileStoragePath,
+		owned = append(owned, shortURL)
+		records = append(records, walRecord{Op: walOpDelete, ShortURLId: shortURL, UserUUID: userUUID, DeletedAt: &deletedAt, UpdatedAt: &deletedAt})
 	}
 
-	if fileStoragePath != "" {
-		file, err := os.OpenFile(fileStoragePath, os.O_RDONLY, 0777)
-
-		if err == nil {
-			defer file.Close()
-			err = json.NewDecoder(file).Decode(&s.db)
-		} else {
-			fmt.Println("Storage could not be created from file", fileStoragePath, err)
-		}
-
-		if err == nil {
-			for shortenURLId, originalURL := range s.db {
-				s.keysDB[originalURL] = shortenURLId
-			}
-		} else {
-			fmt.Println("Storage could not be created from file", fileStoragePath, err)
+	err := s.wal.append(records...)
+	if err == nil {
+		for _, shortURL := range owned {
+			s.markDeleted(userUUID, shortURL, deletedAt)
+			s.touch(shortURL, deletedAt)
 		}
 	}
 
-	return s
-}
+	s.usersArcMux.Unlock()
+	s.dbMux.Unlock()
 
-type V2 struct {
-	Interface
+	s.compactIfNeeded()
 
-	baseURL string
-	dbPool  *pgxpool.Pool
+	return err
 }
 
-func InitV2(baseURL string, dbContext context.Context, connString string) (*V2, error) {
-	conn, err := pgxpool.Connect(dbContext, connString)
-	if err != nil {
+// RestoreKeys brings back the links deleted by the user which are not purged
+// yet and returns the restored ones.
+func (s *V1) RestoreKeys(ctx context.Context, items []string, userUUID string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	log.Printf("Connected to DB %s successfully\n", connString)
-
-	tx, err := conn.Begin(dbContext)
-	if err != nil {
-		return nil, err
-	}
+	s.dbMux.Lock()
+	s.usersArcMux.Lock()
 
-	defer tx.Rollback(context.TODO())
+	restored := make([]string, 0, len(items))
+	records := make([]walRecord, 0, len(items))
 
-	{
-		sql := "CREATE TABLE IF NOT EXISTS shortensArchive (" +
-			"originalURL text UNIQUE, " +
-			"shortenURLId SERIAL " +
-			");"
-		_, err = tx.Exec(context.TODO(), sql)
-		if err != nil {
-			return nil, err
+	now := time.Now().UTC()
+	for _, shortURL := range items {
+		isPresent, isOwned := s.usersArchive[userUUID][shortURL]
+		if _, ok := s.db[shortURL]; !ok || !isOwned || isPresent || s.isExpired(shortURL, now) {
+			continue
 		}
+
+		restored = append(restored, shortURL)
+		records = append(records, walRecord{Op: walOpOwn, ShortURLId: shortURL, UserUUID: userUUID, UpdatedAt: &now})
 	}
-	{
-		sql := "CREATE TABLE IF NOT EXISTS usersArchive (" +
-			"userUUID text, " +
-			"shortenURLId text, " +
-			"isPresent boolean DEFAULT TRUE, " +
-			"PRIMARY KEY (userUUID, shortenURLId) " +
-			");"
-		_, err = tx.Exec(context.TODO(), sql)
-		if err != nil {
-			return nil, err
+
+	err := s.wal.append(records...)
+	if err == nil {
+		for _, shortURL := range restored {
+			s.markOwned(userUUID, shortURL)
+			s.touch(shortURL, now)
 		}
 	}
 
-	err = tx.Commit(dbContext)
+	s.usersArcMux.Unlock()
+	s.dbMux.Unlock()
+
 	if err != nil {
 		return nil, err
 	}
 
-	log.Println("Created metrics Table successfully")
+	s.compactIfNeeded()
 
-	return &V2{baseURL: baseURL, dbPool: conn}, nil
+	return restored, nil
 }
 
-func (s *V2) Ping() error {
-	return s.dbPool.Ping(context.TODO())
+// markOwned, markDeleted and disown must be called with usersArcMux locked.
+func (s *V1) markOwned(userUUID, shortenURLId string) {
+	if s.usersArchive[userUUID] == nil {
+		s.usersArchive[userUUID] = make(setStringType)
+	}
+
+	s.usersArchive[userUUID][shortenURLId] = true
+	delete(s.deleted[userUUID], shortenURLId)
 }
 
-func (s *V2) ShortenURL(originalURL string, userUUID string) (string, error) {
-	shortenURLId := ""
-	id := 0
+// markDeleted skips the links the user does not own, the logs written before
+// the ownership was checked may have such records.
+func (s *V1) markDeleted(userUUID, shortenURLId string, deletedAt time.Time) {
+	if _, isOwned := s.usersArchive[userUUID][shortenURLId]; !isOwned {
+		return
+	}
 
-	tx, _ := s.dbPool.Begin(context.TODO())
-	defer tx.Rollback(context.TODO())
+	if s.deleted[userUUID] == nil {
+		s.deleted[userUUID] = make(deletedSet)
+	}
 
-	var alreadyShortedURLErr error
+	s.usersArchive[userUUID][shortenURLId] = false
+	if _, ok := s.deleted[userUUID][shortenURLId]; !ok {
+		s.deleted[userUUID][shortenURLId] = deletedAt
+	}
+}
 
-	sql := "SELECT shortenURLId FROM shortensArchive WHERE originalURL=$1"
-	err := s.dbPool.QueryRow(context.TODO(), sql, originalURL).Scan(&id)
-	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			sql = "INSERT INTO shortensArchive (originalURL) " +
-				"VALUES ($1) ON CONFLICT (originalURL) " +
-				"DO UPDATE SET originalURL=EXCLUDED.originalURL " +
-				"RETURNING shortenURLId;"
-			err := tx.QueryRow(context.TODO(), sql, originalURL).Scan(&id)
-			if err != nil {
-				return "", err
-			}
-		} else {
-			return "", err
-		}
-	} else {
-		alreadyShortedURLErr = ErrValueAlreadyShorted
+func (s *V1) disown(userUUID, shortenURLId string) {
+	delete(s.usersArchive[userUUID], shortenURLId)
+	delete(s.deleted[userUUID], shortenURLId)
+	delete(s.labels[userUUID], shortenURLId)
+}
+
+// isExpired must be called with dbMux locked.
+func (s *V1) isExpired(shortenURLId string, now time.Time) bool {
+	expiresAt, ok := s.expires[shortenURLId]
+	return ok && !expiresAt.After(now)
+}
+
+// purge physically removes the links, it must be called with dbMux locked.
+func (s *V1) purge(ids []string) error {
+	if len(ids) == 0 {
+		return nil
 	}
 
-	shortenURLId = strconv.Itoa(id)
+	records := make([]walRecord, len(ids))
+	for i, shortenURLId := range ids {
+		records[i] = walRecord{Op: walOpPurge, ShortURLId: shortenURLId}
+	}
 
-	if userUUID != "" {
-		sql = "INSERT INTO usersArchive (userUUID, shortenURLId) " +
-			"VALUES ($1, $2) ON CONFLICT DO NOTHING;"
-		_, err = tx.Exec(context.TODO(), sql, userUUID, shortenURLId)
-		if err != nil {
-			return "", err
-		}
+	if err := s.wal.append(records...); err != nil {
+		return err
 	}
 
-	if err := tx.Commit(context.TODO()); err != nil {
-		return "", err
+	s.usersArcMux.Lock()
+	defer s.usersArcMux.Unlock()
+
+	s.clicksMux.Lock()
+	defer s.clicksMux.Unlock()
+
+	for _, shortenURLId := range ids {
+		s.purgeLink(shortenURLId)
 	}
 
-	return s.baseURL + "/" + shortenURLId, alreadyShortedURLErr
+	return nil
 }
 
-func (s *V2) GetOriginalURL(shortenURLId string, userUUID string) (string, error) {
-	if userUUID != "" {
-		isPresent := false
-		sql := "SELECT isPresent FROM usersArchive WHERE userUUID=$1 AND shortenURLId=$2;"
-		err := s.dbPool.QueryRow(context.TODO(), sql, userUUID, shortenURLId).Scan(&isPresent)
-		if err != nil {
-			if errors.Is(err, pgx.ErrNoRows) {
-				return "", ErrValueNotFound
-			} else {
-				return "", err
+// unindex removes the dedupe key of the link, it must be called with dbMux
+// locked.
+func (s *V1) unindex(originalURL, userUUID, shortenURLId string) {
+	dedupeKey, isDeduped := s.dedupe.key(originalURL, userUUID)
+	if isDeduped && s.keysDB[dedupeKey] == shortenURLId {
+		delete(s.keysDB, dedupeKey)
+	}
+}
+
+// backfillDeleted starts the retention period of the links deleted before the
+// deletion moments were stored, it must be called with usersArcMux locked.
+func (s *V1) backfillDeleted() {
+	now := time.Now().UTC()
+
+	for userUUID, urls := range s.usersArchive {
+		for shortenURLId, isPresent := range urls {
+			if !isPresent {
+				s.markDeleted(userUUID, shortenURLId, now)
 			}
 		}
+	}
+}
 
-		if !isPresent {
-			return "", ErrValueGone
+// reindex rebuilds keysDB for the configured dedupe scope, it must be called
+// with dbMux and usersArcMux locked.
+func (s *V1) reindex() {
+	s.keysDB = make(map[string]string)
+
+	for userUUID, urls := range s.usersArchive {
+		for shortenURLId := range urls {
+			if s.isAlias(shortenURLId) {
+				continue
+			}
+
+			if originalURL, ok := s.db[shortenURLId]; ok {
+				if dedupeKey, isDeduped := s.dedupe.key(originalURL, userUUID); isDeduped {
+					s.keysDB[dedupeKey] = shortenURLId
+				}
+			}
 		}
 	}
 
-	originalURL := ""
+	for shortenURLId, originalURL := range s.db {
+		if s.isAlias(shortenURLId) {
+			continue
+		}
 
-	sql := "SELECT originalURL FROM shortensArchive WHERE shortenURLId=$1"
-	err := s.dbPool.QueryRow(context.TODO(), sql, shortenURLId).Scan(&originalURL)
-	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return "", ErrValueNotFound
-		} else {
-			return "", err
+		if dedupeKey, isDeduped := s.dedupe.key(originalURL, ""); isDeduped {
+			s.keysDB[dedupeKey] = shortenURLId
 		}
 	}
+}
 
-	return originalURL, nil
+// touch moves the update moment of the link, it must be called with dbMux
+// locked.
+func (s *V1) touch(shortenURLId string, updatedAt time.Time) {
+	if meta, ok := s.meta[shortenURLId]; ok && updatedAt.After(meta.UpdatedAt) {
+		meta.UpdatedAt = updatedAt
+	}
 }
 
-func (s *V2) GetUserArchive(userUUID string) ([]UserUrls, error) {
-	sql := "SELECT shortenURLId FROM usersArchive WHERE userUUID=$1;"
-	rows, _ := s.dbPool.Query(context.TODO(), sql)
+// isAlias must be called with dbMux locked.
+func (s *V1) isAlias(shortenURLId string) bool {
+	meta, ok := s.meta[shortenURLId]
+	return ok && meta.Alias
+}
 
-	res := make([]UserUrls, 0)
-	for rows.Next() {
-		shortenURLId := ""
-		err := rows.Scan(&shortenURLId)
-		if err != nil {
-			return nil, err
-		}
+// backfillMeta gives the links created before the metadata was stored the
+// current time, it must be called with dbMux locked.
+func (s *V1) backfillMeta() {
+	now := time.Now().UTC()
 
-		originalURL, err := s.GetOriginalURL(shortenURLId, userUUID)
-		if err != nil {
-			if errors.Is(err, ErrValueNotFound) {
-				continue
-			} else {
-				return nil, err
-			}
+	for shortenURLId := range s.db {
+		if _, ok := s.meta[shortenURLId]; !ok {
+			s.meta[shortenURLId] = &linkMeta{CreatedAt: now, UpdatedAt: now}
 		}
+	}
+}
 
-		res = append(res, UserUrls{
-			OriginalURL: originalURL,
-			ShortURL:    s.baseURL + "/" + shortenURLId,
-		})
+// purgeLink must be called with all the mutexes locked.
+func (s *V1) purgeLink(shortenURLId string) {
+	originalURL := s.db[shortenURLId]
+	s.unindex(originalURL, "", shortenURLId)
+
+	for userUUID, urls := range s.usersArchive {
+		if _, ok := urls[shortenURLId]; ok {
+			s.unindex(originalURL, userUUID, shortenURLId)
+			s.disown(userUUID, shortenURLId)
+		}
 	}
 
-	return res, nil
+	delete(s.db, shortenURLId)
+	delete(s.expires, shortenURLId)
+	delete(s.meta, shortenURLId)
+	delete(s.clicks, shortenURLId)
 }
 
-func (s *V2) ForEach(mapItem []MappingItem, userUUID string, handler func(CorrelationID string, ShortURL string) error) error {
-	for _, iterItem := range mapItem {
-		//TODO may be better use SendBatch
-		shortURL, err := s.ShortenURL(iterItem.OriginalURL, userUUID)
-		if err == nil {
-			err = handler(iterItem.CorrelationID, shortURL)
-			if err != nil {
-				return err
-			}
+func (s *V1) PurgeExpired(ctx context.Context, now time.Time) (int, error) {
+	s.dbMux.Lock()
+
+	expired := make([]string, 0)
+	for shortenURLId := range s.expires {
+		if s.isExpired(shortenURLId, now) {
+			expired = append(expired, shortenURLId)
 		}
 	}
 
-	return nil
-}
+	err := s.purge(expired)
+	s.dbMux.Unlock()
 
-func (s *V2) DeleteKeys(items []string, userUUID string) error {
-	tx, err := s.dbPool.Begin(context.TODO())
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	defer tx.Rollback(context.TODO())
+	s.compactIfNeeded()
+
+	return len(expired), nil
+}
 
-	var wg sync.WaitGroup
+// PurgeDeleted forgets the links deleted by their owners before
+// deletedBefore and physically removes the ones no one else owns.
+func (s *V1) PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 
-	sql := "UPDATE usersArchive " +
-		"SET isPresent=FALSE " +
-		"WHERE userUUID=$1 AND shortenURLId=$2;"
+	s.dbMux.Lock()
+	s.usersArcMux.Lock()
 
-	for _, shortURLsChunks := range common.Chunks(items, 15) {
-		wg.Add(1)
+	records := make([]walRecord, 0)
+	for userUUID, deleted := range s.deleted {
+		for shortenURLId, deletedAt := range deleted {
+			if !deletedAt.After(deletedBefore) {
+				records = append(records, walRecord{Op: walOpDisown, ShortURLId: shortenURLId, UserUUID: userUUID})
+			}
+		}
+	}
 
-		go func(shortURLsChunks []string) {
-			defer wg.Done()
+	orphans := make([]string, 0)
 
-			b := &pgx.Batch{}
+	err := s.wal.append(records...)
+	if err == nil {
+		for _, record := range records {
+			s.disown(record.UserUUID, record.ShortURLId)
+		}
 
-			for _, shortURL := range shortURLsChunks {
-				b.Queue(sql, userUUID, shortURL)
+		for _, record := range records {
+			if _, ok := s.db[record.ShortURLId]; ok && !s.isOwned(record.ShortURLId) {
+				orphans = append(orphans, record.ShortURLId)
 			}
+		}
+	}
 
-			batchResults := tx.SendBatch(context.TODO(), b)
+	s.usersArcMux.Unlock()
 
-			var err error
-			for err == nil {
-				_, err = batchResults.Exec()
-				if err != nil && err.Error() != "no result" {
-					tx.Rollback(context.TODO())
-					return
-				}
-			}
-		}(shortURLsChunks)
+	if err == nil {
+		err = s.purge(orphans)
 	}
 
-	wg.Wait()
+	s.dbMux.Unlock()
 
-	return tx.Commit(context.TODO())
+	if err != nil {
+		return 0, err
+	}
+
+	s.compactIfNeeded()
+
+	return len(orphans), nil
+}
+
+// isOwned must be called with usersArcMux locked.
+func (s *V1) isOwned(shortenURLId string) bool {
+	for _, urls := range s.usersArchive {
+		if _, ok := urls[shortenURLId]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *V1) applyWALRecord(record walRecord) {
+	switch record.Op {
+	case walOpCreate:
+		s.db[record.ShortURLId] = record.OriginalURL
+
+		if record.Seq > s.seq {
+			s.seq = record.Seq
+		}
+
+		if record.ExpiresAt != nil {
+			s.expires[record.ShortURLId] = *record.ExpiresAt
+		}
+
+		if record.CreatedAt != nil {
+			s.meta[record.ShortURLId] = &linkMeta{
+				CreatedAt:   *record.CreatedAt,
+				CreatedBy:   record.UserUUID,
+				UpdatedAt:   *record.CreatedAt,
+				Title:       record.Title,
+				Description: record.Description,
+				Preview:     record.Preview,
+				Alias:       record.Alias,
+			}
+		}
+	case walOpPurge:
+		s.purgeLink(record.ShortURLId)
+	case walOpClick:
+		// The clicks recorded before the link was purged are dropped.
+		if _, ok := s.db[record.ShortURLId]; !ok {
+			break
+		}
+
+		s.addClick(Click{
+			ShortURLId: record.ShortURLId,
+			Time:       *record.ClickedAt,
+			Referrer:   record.Referrer,
+			UserAgent:  record.UserAgent,
+			IPHash:     record.IPHash,
+		})
+	case walOpKeyCreate:
+		s.apiKeys[record.KeyHash] = &storedAPIKey{
+			APIKey:   APIKey{ID: record.KeyID, Name: record.KeyName, CreatedAt: *record.CreatedAt},
+			UserUUID: record.UserUUID,
+		}
+	case walOpKeyRevoke:
+		delete(s.apiKeys, record.KeyHash)
+	case walOpOwn:
+		s.markOwned(record.UserUUID, record.ShortURLId)
+	case walOpDelete:
+		deletedAt := time.Now().UTC()
+		if record.DeletedAt != nil {
+			deletedAt = *record.DeletedAt
+		}
+
+		s.markDeleted(record.UserUUID, record.ShortURLId, deletedAt)
+	case walOpDisown:
+		s.disown(record.UserUUID, record.ShortURLId)
+	case walOpTag:
+		s.addTags(record.UserUUID, record.ShortURLId, record.Tags)
+	case walOpUntag:
+		s.removeTags(record.UserUUID, record.ShortURLId, record.Tags)
+	case walOpMove:
+		s.moveToFolder(record.UserUUID, record.ShortURLId, record.Folder)
+	}
+
+	if record.UpdatedAt != nil {
+		s.touch(record.ShortURLId, *record.UpdatedAt)
+	}
+}
+
+// compact writes a snapshot of the whole storage state and truncates the log.
+func (s *V1) compact() error {
+	s.dbMux.Lock()
+	defer s.dbMux.Unlock()
+
+	s.usersArcMux.Lock()
+	defer s.usersArcMux.Unlock()
+
+	s.clicksMux.Lock()
+	defer s.clicksMux.Unlock()
+
+	s.apiKeysMux.Lock()
+	defer s.apiKeysMux.Unlock()
+
+	err := writeSnapshot(s.fileStoragePath, &snapshot{
+		Version:    snapshotVersion,
+		Seq:        s.seq,
+		AppliedLSN: s.wal.lastLSN(),
+		Links:      s.db,
+		Expires:    s.expires,
+		Meta:       s.meta,
+		Users:      s.usersArchive,
+		Deleted:    s.deleted,
+		Labels:     s.labels,
+		Clicks:     s.clicks,
+		APIKeys:    s.apiKeys,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.wal.rewrite(nil)
+}
+
+func (s *V1) compactIfNeeded() {
+	if s.wal.needsCompaction() {
+		if err := s.compact(); err != nil {
+			log.Println("Storage could not be compacted", s.fileStoragePath, err)
+		}
+	}
+}
+
+// Close flushes the storage state to the snapshot and closes the log.
+func (s *V1) Close() error {
+	if s.wal == nil {
+		return nil
+	}
+
+	if err := s.compact(); err != nil {
+		return err
+	}
+
+	return s.wal.close()
+}
+
+// InitV1 creates the storage restoring it from fileStoragePath when set. The
+// storage is not created if the file can not be restored, so it is never
+// served without its data.
+func InitV1(baseURL, fileStoragePath string, idGen idgen.Generator, dedupe DedupeScope) (*V1, error) {
+	s := &V1{
+		db:              make(map[string]string),
+		keysDB:          make(map[string]string),
+		expires:         make(map[string]time.Time),
+		meta:            make(map[string]*linkMeta),
+		usersArchive:    make(map[string]setStringType),
+		deleted:         make(map[string]deletedSet),
+		labels:          make(map[string]userLabels),
+		clicks:          make(map[string]*linkClicks),
+		apiKeys:         make(map[string]*storedAPIKey),
+		idGen:           idGen,
+		dedupe:          dedupe,
+		baseURL:         baseURL,
+		fileStoragePath: fileStoragePath,
+	}
+
+	if fileStoragePath == "" {
+		return s, nil
+	}
+
+	snap, diskVersion, err := readSnapshot(fileStoragePath)
+	if err != nil {
+		return nil, fmt.Errorf("storage could not be created from file %s: %w", fileStoragePath, err)
+	}
+
+	if diskVersion < snapshotVersion {
+		// The old file is copied rather than moved, so the storage file is in
+		// place until the migrated snapshot atomically replaces it.
+		backupPath := fmt.Sprintf("%s.v%d.bak", fileStoragePath, diskVersion)
+		if err = copyFileSync(fileStoragePath, backupPath); err != nil {
+			return nil, fmt.Errorf("storage file %s could not be backed up: %w", fileStoragePath, err)
+		}
+
+		log.Printf("Storage file %s migrated from version %d, old file is kept at %s\n", fileStoragePath, diskVersion, backupPath)
+	}
+
+	s.db = snap.Links
+	s.expires = snap.Expires
+	s.meta = snap.Meta
+	s.usersArchive = snap.Users
+	s.deleted = snap.Deleted
+	s.labels = snap.Labels
+	s.clicks = snap.Clicks
+	s.apiKeys = snap.APIKeys
+	s.seq = snap.Seq
+
+	s.wal, err = openWAL(fileStoragePath + ".wal")
+	if err == nil {
+		err = s.wal.replay(snap.AppliedLSN, s.applyWALRecord)
+	}
+
+	if err != nil {
+		s.wal.close()
+		return nil, fmt.Errorf("storage log %s could not be restored: %w", fileStoragePath, err)
+	}
+
+	s.reindex()
+	s.backfillDeleted()
+	s.backfillMeta()
+
+	if err = s.compact(); err != nil {
+		s.wal.close()
+		return nil, fmt.Errorf("storage file %s could not be written: %w", fileStoragePath, err)
+	}
+
+	return s, nil
+}
+
+type V2 struct {
+	Interface
+
+	idGen   idgen.Generator
+	dedupe  DedupeScope
+	baseURL string
+	dbPool  *pgxpool.Pool
+}
+
+func InitV2(baseURL string, dbContext context.Context, connString string, idGen idgen.Generator, dedupe DedupeScope) (*V2, error) {
+	conn, err := pgxpool.Connect(dbContext, connString)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Connected to DB %s successfully\n", connString)
+
+	migrationsList, err := migrations.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	err = migrations.New(conn, migrationsList).Up(dbContext)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("Database schema is up to date")
+
+	stor := &V2{idGen: idGen, dedupe: dedupe, baseURL: baseURL, dbPool: conn}
+
+	if dedupe == DedupeGlobal {
+		if err = stor.rekeyLegacyLinks(dbContext); err != nil {
+			return nil, err
+		}
+	}
+
+	return stor, nil
+}
+
+// rekeyLegacyLinks gives the canonical dedupe keys to the links stored before
+// the URLs were normalized, their keys are the URLs themselves. A key already
+// taken by another link is left as it is.
+func (s *V2) rekeyLegacyLinks(ctx context.Context) error {
+	sql := "SELECT shortenURLId, originalURL FROM shortensArchive WHERE dedupeKey = originalURL;"
+	rows, err := s.dbPool.Query(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]string)
+	for rows.Next() {
+		var shortenURLId, originalURL string
+		if err = rows.Scan(&shortenURLId, &originalURL); err != nil {
+			rows.Close()
+			return err
+		}
+
+		if key := urlpolicy.Key(originalURL); key != originalURL {
+			keys[shortenURLId] = key
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	sql = "UPDATE shortensArchive SET dedupeKey=$1 WHERE shortenURLId=$2 " +
+		"AND NOT EXISTS (SELECT 1 FROM shortensArchive WHERE dedupeKey=$1);"
+	for shortenURLId, key := range keys {
+		if _, err = s.dbPool.Exec(ctx, sql, key, shortenURLId); err != nil {
+			return err
+		}
+	}
+
+	if len(keys) != 0 {
+		log.Println("Dedupe keys of the legacy links are rewritten", len(keys))
+	}
+
+	return nil
+}
+
+func (s *V2) Ping(ctx context.Context) error {
+	return s.dbPool.Ping(ctx)
+}
+
+// tryInsertLink stores originalURL under shortenURLId. If a link with the
+// same dedupe key was concurrently stored by someone else its ID is returned
+// with ErrValueAlreadyShorted, ErrIDCollision means shortenURLId is taken.
+func (s *V2) tryInsertLink(ctx context.Context, tx pgx.Tx, originalURL string, dedupeKey *string, shortenURLId string, userUUID string, opts ShortenOptions, expiresAt *time.Time) (string, error) {
+	sql := "INSERT INTO shortensArchive (originalURL, dedupeKey, shortenURLId, expiresAt, createdBy, title, description, preview) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT DO NOTHING " +
+		"RETURNING shortenURLId;"
+	err := tx.QueryRow(ctx, sql, originalURL, dedupeKey, shortenURLId, expiresAt, userUUID, opts.Title, opts.Description, opts.Preview).Scan(&shortenURLId)
+	if err == nil {
+		return shortenURLId, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return "", err
+	}
+
+	if dedupeKey == nil {
+		return "", ErrIDCollision
+	}
+
+	sql = "SELECT shortenURLId FROM shortensArchive WHERE dedupeKey=$1"
+	err = tx.QueryRow(ctx, sql, *dedupeKey).Scan(&shortenURLId)
+	if err == nil {
+		return shortenURLId, ErrValueAlreadyShorted
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return "", err
+	}
+
+	return "", ErrIDCollision
+}
+
+// insertLink stores originalURL under the alias or a newly generated ID.
+func (s *V2) insertLink(ctx context.Context, tx pgx.Tx, originalURL string, dedupeKey *string, userUUID string, opts ShortenOptions) (string, error) {
+	expiresAt := opts.Expiry(time.Now())
+
+	if opts.Alias != "" {
+		shortenURLId, err := s.tryInsertLink(ctx, tx, originalURL, dedupeKey, opts.Alias, userUUID, opts, expiresAt)
+		if errors.Is(err, ErrIDCollision) {
+			return s.existingAlias(ctx, tx, originalURL, opts.Alias)
+		}
+
+		return shortenURLId, err
+	}
+
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		var seq int64
+		err := tx.QueryRow(ctx, "SELECT nextval('shortensArchive_seq');").Scan(&seq)
+		if err != nil {
+			return "", err
+		}
+
+		shortenURLId, err := s.idGen.Generate(uint64(seq))
+		if err != nil {
+			return "", err
+		}
+
+		shortenURLId, err = s.tryInsertLink(ctx, tx, originalURL, dedupeKey, shortenURLId, userUUID, opts, expiresAt)
+		if !errors.Is(err, ErrIDCollision) {
+			return shortenURLId, err
+		}
+	}
+
+	return "", ErrIDCollision
+}
+
+// existingAlias returns the taken alias with ErrValueAlreadyShorted when it is
+// the link of the same URL, ErrAliasTaken otherwise.
+func (s *V2) existingAlias(ctx context.Context, tx pgx.Tx, originalURL string, alias string) (string, error) {
+	aliasURL := ""
+	var expiresAt *time.Time
+
+	sql := "SELECT originalURL, expiresAt FROM shortensArchive WHERE shortenURLId=$1;"
+	err := tx.QueryRow(ctx, sql, alias).Scan(&aliasURL, &expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrAliasTaken
+	} else if err != nil {
+		return "", err
+	}
+
+	if aliasURL != originalURL || (expiresAt != nil && !expiresAt.After(time.Now())) {
+		return "", ErrAliasTaken
+	}
+
+	return alias, ErrValueAlreadyShorted
+}
+
+func (s *V2) ShortenURL(ctx context.Context, originalURL string, userUUID string, opts ShortenOptions) (string, error) {
+	shortenURLId := ""
+
+	tx, err := s.dbPool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	defer tx.Rollback(ctx)
+
+	var alreadyShortedURLErr error
+	var expiresAt *time.Time
+	var dedupeKey *string
+
+	err = pgx.ErrNoRows
+	if key, isDeduped := s.dedupe.linkKey(originalURL, userUUID, opts); isDeduped {
+		dedupeKey = &key
+
+		sql := "SELECT shortenURLId, expiresAt FROM shortensArchive WHERE dedupeKey=$1"
+		err = tx.QueryRow(ctx, sql, key).Scan(&shortenURLId, &expiresAt)
+	}
+
+	if err == nil && expiresAt != nil && !expiresAt.After(time.Now()) {
+		if _, err = purgeLinks(ctx, tx, "shortenURLId=$1", shortenURLId); err != nil {
+			return "", err
+		}
+
+		err = pgx.ErrNoRows
+	}
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			shortenURLId, err = s.insertLink(ctx, tx, originalURL, dedupeKey, userUUID, opts)
+			if errors.Is(err, ErrValueAlreadyShorted) {
+				alreadyShortedURLErr = err
+			} else if err != nil {
+				return "", err
+			}
+		} else {
+			return "", err
+		}
+	} else {
+		alreadyShortedURLErr = ErrValueAlreadyShorted
+	}
+
+	if userUUID != "" {
+		sql := "INSERT INTO usersArchive (userUUID, shortenURLId) " +
+			"VALUES ($1, $2) ON CONFLICT DO NOTHING;"
+		_, err = tx.Exec(ctx, sql, userUUID, shortenURLId)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	return s.baseURL + "/" + shortenURLId, alreadyShortedURLErr
+}
+
+func (s *V2) GetOriginalURL(ctx context.Context, shortenURLId string, userUUID string) (string, error) {
+	if userUUID != "" {
+		isPresent := false
+		sql := "SELECT isPresent FROM usersArchive WHERE userUUID=$1 AND shortenURLId=$2;"
+		err := s.dbPool.QueryRow(ctx, sql, userUUID, shortenURLId).Scan(&isPresent)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return "", ErrValueNotFound
+			} else {
+				return "", err
+			}
+		}
+
+		if !isPresent {
+			return "", ErrValueGone
+		}
+	}
+
+	originalURL := ""
+	var expiresAt *time.Time
+
+	sql := "SELECT originalURL, expiresAt FROM shortensArchive WHERE shortenURLId=$1"
+	err := s.dbPool.QueryRow(ctx, sql, shortenURLId).Scan(&originalURL, &expiresAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", ErrValueNotFound
+		} else {
+			return "", err
+		}
+	}
+
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return "", ErrValueGone
+	}
+
+	return originalURL, nil
+}
+
+// ForEach shortens all the items in a single transaction, the handler is
+// called once it is committed. Only the storage failures abort the
+// transaction, the errors of the single items are passed to the handler.
+func (s *V2) ForEach(ctx context.Context, mapItem []MappingItem, userUUID string, handler func(CorrelationID string, ShortURL string, err error) error) error {
+	tx, err := s.dbPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+
+	shortenURLIds, itemErrs, err := s.shortenBatch(ctx, tx, mapItem, userUUID)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	for i, iterItem := range mapItem {
+		shortURL := ""
+		if shortenURLIds[i] != "" {
+			shortURL = s.baseURL + "/" + shortenURLIds[i]
+		}
+
+		if err = handler(iterItem.CorrelationID, shortURL, itemErrs[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// shortenBatch stores the links of the items with a few set based queries
+// instead of a round trip per item. The IDs and the errors are returned in the
+// items order the same way ShortenURL returns them, the error is only set on
+// a storage failure.
+func (s *V2) shortenBatch(ctx context.Context, tx pgx.Tx, items []MappingItem, userUUID string) ([]string, []error, error) {
+	now := time.Now()
+
+	shortenURLIds := make([]string, len(items))
+	itemErrs := make([]error, len(items))
+
+	dedupeKeys := make([]*string, len(items))
+	keys := make([]string, 0, len(items))
+	for i, item := range items {
+		if key, isDeduped := s.dedupe.linkKey(item.OriginalURL, userUUID, item.ShortenOptions); isDeduped {
+			dedupeKeys[i] = &key
+			keys = append(keys, key)
+		}
+	}
+
+	existing := make(map[string]string)
+	if len(keys) != 0 {
+		expired := make([]string, 0)
+
+		sql := "SELECT dedupeKey, shortenURLId, expiresAt FROM shortensArchive WHERE dedupeKey = ANY($1);"
+		rows, err := tx.Query(ctx, sql, keys)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for rows.Next() {
+			key, shortenURLId := "", ""
+			var expiresAt *time.Time
+			if err = rows.Scan(&key, &shortenURLId, &expiresAt); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+
+			if expiresAt != nil && !expiresAt.After(now) {
+				expired = append(expired, shortenURLId)
+			} else {
+				existing[key] = shortenURLId
+			}
+		}
+
+		if err = rows.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		if len(expired) != 0 {
+			if _, err = purgeLinks(ctx, tx, "shortenURLId = ANY($1)", expired); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	// firstItems maps the dedupe keys to the first item storing the link,
+	// the repeated items get its link.
+	firstItems := make(map[string]int)
+	repeated := make([]int, 0)
+
+	pending := make([]int, 0, len(items))
+	generated := 0
+	for i, item := range items {
+		if key := dedupeKeys[i]; key != nil {
+			if shortenURLId, ok := existing[*key]; ok {
+				shortenURLIds[i], itemErrs[i] = shortenURLId, ErrValueAlreadyShorted
+				continue
+			}
+
+			if _, ok := firstItems[*key]; ok {
+				repeated = append(repeated, i)
+				continue
+			}
+
+			firstItems[*key] = i
+		}
+
+		pending = append(pending, i)
+		if item.Alias == "" {
+			generated++
+		}
+	}
+
+	seqs := make([]int64, 0, generated)
+	if generated != 0 {
+		sql := "SELECT nextval('shortensArchive_seq') FROM generate_series(1, $1);"
+		rows, err := tx.Query(ctx, sql, generated)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for rows.Next() {
+			var seq int64
+			if err = rows.Scan(&seq); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+
+			seqs = append(seqs, seq)
+		}
+
+		if err = rows.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Items with an ID repeated within the batch can not be inserted by the
+	// same query, they are retried one by one.
+	retried := make([]int, 0)
+	seen := make(map[string]bool)
+
+	originalURLs := make([]string, 0, len(pending))
+	titles := make([]string, 0, len(pending))
+	descriptions := make([]string, 0, len(pending))
+	previews := make([]bool, 0, len(pending))
+	insertKeys := make([]*string, 0, len(pending))
+	insertIds := make([]string, 0, len(pending))
+	expiresAts := make([]*time.Time, 0, len(pending))
+
+	for _, i := range pending {
+		shortenURLId := items[i].Alias
+		if shortenURLId == "" {
+			var err error
+			shortenURLId, err = s.idGen.Generate(uint64(seqs[0]))
+			if err != nil {
+				return nil, nil, err
+			}
+
+			seqs = seqs[1:]
+		}
+
+		if seen[shortenURLId] {
+			retried = append(retried, i)
+			continue
+		}
+
+		seen[shortenURLId] = true
+		shortenURLIds[i] = shortenURLId
+
+		originalURLs = append(originalURLs, items[i].OriginalURL)
+		titles = append(titles, items[i].Title)
+		descriptions = append(descriptions, items[i].Description)
+		previews = append(previews, items[i].Preview)
+		insertKeys = append(insertKeys, dedupeKeys[i])
+		insertIds = append(insertIds, shortenURLId)
+		expiresAts = append(expiresAts, items[i].Expiry(now))
+	}
+
+	inserted := make(map[string]bool)
+	if len(insertIds) != 0 {
+		sql := "INSERT INTO shortensArchive (originalURL, dedupeKey, shortenURLId, expiresAt, title, description, preview, createdBy) " +
+			"SELECT *, $8 FROM unnest($1::text[], $2::text[], $3::text[], $4::timestamptz[], $5::text[], $6::text[], $7::boolean[]) " +
+			"ON CONFLICT DO NOTHING " +
+			"RETURNING shortenURLId;"
+		rows, err := tx.Query(ctx, sql, originalURLs, insertKeys, insertIds, expiresAts, titles, descriptions, previews, userUUID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for rows.Next() {
+			shortenURLId := ""
+			if err = rows.Scan(&shortenURLId); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+
+			inserted[shortenURLId] = true
+		}
+
+		if err = rows.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, i := range pending {
+		if shortenURLIds[i] != "" && !inserted[shortenURLIds[i]] {
+			shortenURLIds[i] = ""
+			retried = append(retried, i)
+		}
+	}
+
+	// The taken IDs and the links concurrently stored by someone else are
+	// handled the same way as by ShortenURL.
+	retry := func(i int) error {
+		shortenURLId, err := s.insertLink(ctx, tx, items[i].OriginalURL, dedupeKeys[i], userUUID, items[i].ShortenOptions)
+		if err != nil && !errors.Is(err, ErrValueAlreadyShorted) && !errors.Is(err, ErrAliasTaken) && !errors.Is(err, ErrIDCollision) {
+			return err
+		}
+
+		shortenURLIds[i], itemErrs[i] = shortenURLId, err
+		return nil
+	}
+
+	for _, i := range retried {
+		if err := retry(i); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, i := range repeated {
+		first := firstItems[*dedupeKeys[i]]
+		if shortenURLIds[first] != "" {
+			shortenURLIds[i], itemErrs[i] = shortenURLIds[first], ErrValueAlreadyShorted
+		} else if err := retry(i); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	owned := make([]string, 0, len(items))
+	for _, shortenURLId := range shortenURLIds {
+		if shortenURLId != "" {
+			owned = append(owned, shortenURLId)
+		}
+	}
+
+	if userUUID != "" && len(owned) != 0 {
+		sql := "INSERT INTO usersArchive (userUUID, shortenURLId) " +
+			"SELECT $1, unnest($2::text[]) ON CONFLICT DO NOTHING;"
+		if _, err := tx.Exec(ctx, sql, userUUID, owned); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return shortenURLIds, itemErrs, nil
+}
+
+func (s *V2) DeleteKeys(ctx context.Context, items []string, userUUID string) error {
+	sql := "WITH deleted AS (" +
+		"UPDATE usersArchive SET isPresent=FALSE, deletedAt=COALESCE(deletedAt, now()) " +
+		"WHERE userUUID=$1 AND shortenURLId = ANY($2) RETURNING shortenURLId) " +
+		"UPDATE shortensArchive SET updatedAt=now() WHERE shortenURLId IN (SELECT shortenURLId FROM deleted);"
+	_, err := s.dbPool.Exec(ctx, sql, userUUID, items)
+
+	return err
+}
+
+func (s *V2) RestoreKeys(ctx context.Context, items []string, userUUID string) ([]string, error) {
+	sql := "WITH restored AS (" +
+		"UPDATE usersArchive SET isPresent=TRUE, deletedAt=NULL " +
+		"WHERE userUUID=$1 AND shortenURLId = ANY($2) AND NOT isPresent " +
+		"AND shortenURLId IN (SELECT shortenURLId FROM shortensArchive WHERE expiresAt IS NULL OR expiresAt > now()) " +
+		"RETURNING shortenURLId), " +
+		"touched AS (UPDATE shortensArchive SET updatedAt=now() WHERE shortenURLId IN (SELECT shortenURLId FROM restored)) " +
+		"SELECT shortenURLId FROM restored;"
+	rows, err := s.dbPool.Query(ctx, sql, userUUID, items)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	restored := make([]string, 0, len(items))
+	for rows.Next() {
+		shortenURLId := ""
+		if err = rows.Scan(&shortenURLId); err != nil {
+			return nil, err
+		}
+
+		restored = append(restored, shortenURLId)
+	}
+
+	return restored, rows.Err()
+}
+
+// purgeLinks physically removes the links matched by the shortensArchive
+// condition together with their ownership.
+func purgeLinks(ctx context.Context, tx pgx.Tx, condition string, args ...interface{}) (int, error) {
+	for _, table := range []string{"usersArchive", "clicks"} {
+		sql := "DELETE FROM " + table + " WHERE shortenURLId IN " +
+			"(SELECT shortenURLId FROM shortensArchive WHERE " + condition + ");"
+		_, err := tx.Exec(ctx, sql, args...)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	sql := "DELETE FROM shortensArchive WHERE " + condition + ";"
+	tag, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(tag.RowsAffected()), nil
+}
+
+func (s *V2) PurgeExpired(ctx context.Context, now time.Time) (int, error) {
+	tx, err := s.dbPool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	purged, err := purgeLinks(ctx, tx, "expiresAt <= $1", now)
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, tx.Commit(ctx)
+}
+
+// PurgeDeleted forgets the links deleted by their owners before
+// deletedBefore and physically removes the ones no one else owns.
+func (s *V2) PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error) {
+	tx, err := s.dbPool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	sql := "DELETE FROM usersArchive WHERE NOT isPresent AND deletedAt <= $1 RETURNING shortenURLId;"
+	rows, err := tx.Query(ctx, sql, deletedBefore)
+	if err != nil {
+		return 0, err
+	}
+
+	disowned := make([]string, 0)
+	for rows.Next() {
+		shortenURLId := ""
+		if err = rows.Scan(&shortenURLId); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		disowned = append(disowned, shortenURLId)
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	if len(disowned) != 0 {
+		condition := "shortenURLId = ANY($1) AND shortenURLId NOT IN (SELECT shortenURLId FROM usersArchive)"
+		if purged, err = purgeLinks(ctx, tx, condition, disowned); err != nil {
+			return 0, err
+		}
+	}
+
+	return purged, tx.Commit(ctx)
+}
+
+// RunSweeper purges expired links every interval until ctx is done. The links
+// deleted by their owners are purged after the retention period, a
+// non-positive retention keeps them forever. A non-positive interval disables
+// the sweeper.
+func RunSweeper(ctx context.Context, stor Interface, interval, retention time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			purged, err := stor.PurgeExpired(ctx, now)
+			if err != nil {
+				log.Println("Expired links could not be purged", err)
+			} else if purged > 0 {
+				log.Println("Purged expired links", purged)
+			}
+
+			if retention <= 0 {
+				continue
+			}
+
+			purged, err = stor.PurgeDeleted(ctx, now.Add(-retention))
+			if err != nil {
+				log.Println("Deleted links could not be purged", err)
+			} else if purged > 0 {
+				log.Println("Purged deleted links", purged)
+			}
+		}
+	}
 }
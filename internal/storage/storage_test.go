@@ -0,0 +1,965 @@
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GermanVor/shortener-pet-project/internal/idgen"
+	"github.com/GermanVor/shortener-pet-project/internal/storage"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	ctx      = context.Background()
+	baseURL  = "http://127.0.0.1:8080"
+	idGen, _ = idgen.NewHashID(6, idgen.Base62Alphabet, "salt")
+)
+
+func TestV1Persistence(t *testing.T) {
+	fileStoragePath := filepath.Join(t.TempDir(), "storage.json")
+	userUUID := "some_token"
+
+	stor := initV1(t, fileStoragePath, idGen, storage.DedupeGlobal)
+
+	firstURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/1", userUUID, storage.ShortenOptions{})
+	require.NoError(t, err)
+	secondURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/2", userUUID, storage.ShortenOptions{})
+	require.NoError(t, err)
+
+	secondID := secondURL[len(baseURL)+1:]
+	require.NoError(t, stor.DeleteKeys(ctx, []string{secondID}, userUUID))
+
+	// Simulate a crash in the middle of a log append.
+	walFile, err := os.OpenFile(fileStoragePath+".wal", os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = walFile.WriteString(`{"op":"create","id":"3","ur`)
+	require.NoError(t, err)
+	require.NoError(t, walFile.Close())
+
+	restored := initV1(t, fileStoragePath, idGen, storage.DedupeGlobal)
+
+	shortURL, err := restored.ShortenURL(ctx, "http://oknetcumk.biz/1", userUUID, storage.ShortenOptions{})
+	require.ErrorIs(t, err, storage.ErrValueAlreadyShorted)
+	require.Equal(t, firstURL, shortURL)
+
+	_, err = restored.GetOriginalURL(ctx, secondID, userUUID)
+	require.ErrorIs(t, err, storage.ErrValueGone)
+
+	archive, err := restored.GetUserArchive(ctx, userUUID, storage.ArchiveOptions{IncludeDeleted: true})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(archive.URLs))
+
+	thirdURL, err := restored.ShortenURL(ctx, "http://oknetcumk.biz/3", "", storage.ShortenOptions{})
+	require.NoError(t, err)
+
+	thirdID, err := idGen.Generate(3)
+	require.NoError(t, err)
+	require.Equal(t, baseURL+"/"+thirdID, thirdURL)
+
+	require.NoError(t, restored.Close())
+}
+
+func TestV1InterruptedCompaction(t *testing.T) {
+	fileStoragePath := filepath.Join(t.TempDir(), "storage.json")
+	userUUID := "some_token"
+
+	stor := initV1(t, fileStoragePath, idGen, storage.DedupeGlobal)
+
+	shortURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/1", userUUID, storage.ShortenOptions{})
+	require.NoError(t, err)
+
+	shortURLId := shortURL[len(baseURL)+1:]
+	clicks := []storage.Click{
+		{ShortURLId: shortURLId, Time: time.Now()},
+		{ShortURLId: shortURLId, Time: time.Now()},
+		{ShortURLId: shortURLId, Time: time.Now()},
+	}
+	require.NoError(t, stor.RecordClicks(ctx, clicks))
+
+	walData, err := os.ReadFile(fileStoragePath + ".wal")
+	require.NoError(t, err)
+	require.NoError(t, stor.Close())
+
+	// Simulate a crash after the snapshot is written but before the log is
+	// truncated.
+	require.NoError(t, os.WriteFile(fileStoragePath+".wal", walData, 0644))
+
+	restored := initV1(t, fileStoragePath, idGen, storage.DedupeGlobal)
+
+	stats, err := restored.GetLinkStats(ctx, shortURLId, userUUID)
+	require.NoError(t, err)
+	require.Equal(t, 3, stats.Total)
+
+	require.NoError(t, restored.RecordClicks(ctx, clicks[:1]))
+	require.NoError(t, restored.Close())
+
+	restored = initV1(t, fileStoragePath, idGen, storage.DedupeGlobal)
+
+	stats, err = restored.GetLinkStats(ctx, shortURLId, userUUID)
+	require.NoError(t, err)
+	require.Equal(t, 4, stats.Total)
+
+	require.NoError(t, restored.Close())
+}
+
+func TestV1ClicksOfUnknownLinks(t *testing.T) {
+	fileStoragePath := filepath.Join(t.TempDir(), "storage.json")
+
+	// The click of a link unknown to the log is dropped on replay.
+	walRecord := `{"op":"click","id":"unknown","clicked_at":"2024-01-01T00:00:00Z"}` + "\n"
+	require.NoError(t, os.WriteFile(fileStoragePath+".wal", []byte(walRecord), 0644))
+
+	stor := initV1(t, fileStoragePath, idGen, storage.DedupeGlobal)
+
+	expiresAt := time.Now().Add(-time.Minute)
+	shortURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/1", "some_token", storage.ShortenOptions{ExpiresAt: &expiresAt})
+	require.NoError(t, err)
+
+	purged, err := stor.PurgeExpired(ctx, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 1, purged)
+
+	// The clicks buffered before the purge are flushed after it.
+	clicks := []storage.Click{
+		{ShortURLId: shortURL[len(baseURL)+1:], Time: time.Now()},
+		{ShortURLId: "unknown", Time: time.Now()},
+	}
+	require.NoError(t, stor.RecordClicks(ctx, clicks))
+	require.NoError(t, stor.Close())
+
+	data, err := os.ReadFile(fileStoragePath)
+	require.NoError(t, err)
+
+	snap := struct {
+		Clicks map[string]json.RawMessage `json:"clicks"`
+	}{}
+	require.NoError(t, json.Unmarshal(data, &snap))
+	require.Empty(t, snap.Clicks)
+}
+
+func TestV1LegacySnapshotMigration(t *testing.T) {
+	fileStoragePath := filepath.Join(t.TempDir(), "storage.json")
+	legacy := `{"1":"http://oknetcumk.biz/1","2":"http://oknetcumk.biz/2"}`
+	require.NoError(t, os.WriteFile(fileStoragePath, []byte(legacy), 0644))
+
+	stor := initV1(t, fileStoragePath, idGen, storage.DedupeGlobal)
+
+	originalURL, err := stor.GetOriginalURL(ctx, "2", "")
+	require.NoError(t, err)
+	require.Equal(t, "http://oknetcumk.biz/2", originalURL)
+
+	_, err = stor.ShortenURL(ctx, "http://oknetcumk.biz/1", "some_token", storage.ShortenOptions{})
+	require.ErrorIs(t, err, storage.ErrValueAlreadyShorted)
+	require.NoError(t, stor.Close())
+
+	backup, err := os.ReadFile(fileStoragePath + ".v1.bak")
+	require.NoError(t, err)
+	require.Equal(t, legacy, string(backup))
+
+	restored := initV1(t, fileStoragePath, idGen, storage.DedupeGlobal)
+
+	archive, err := restored.GetUserArchive(ctx, "some_token", storage.ArchiveOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(archive.URLs))
+	require.Equal(t, "http://oknetcumk.biz/1", archive.URLs[0].OriginalURL)
+}
+
+func TestV1BrokenFile(t *testing.T) {
+	fileStoragePath := filepath.Join(t.TempDir(), "storage.json")
+	require.NoError(t, os.WriteFile(fileStoragePath, []byte(`{"version":`), 0644))
+
+	_, err := storage.InitV1(baseURL, fileStoragePath, idGen, storage.DedupeGlobal)
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(fileStoragePath, []byte(`{"version":99}`), 0644))
+
+	_, err = storage.InitV1(baseURL, fileStoragePath, idGen, storage.DedupeGlobal)
+	require.ErrorIs(t, err, storage.ErrUnknownSnapshotVersion)
+
+	data, err := os.ReadFile(fileStoragePath)
+	require.NoError(t, err)
+	require.Equal(t, `{"version":99}`, string(data))
+}
+
+type constGenerator string
+
+func (g constGenerator) Generate(seq uint64) (string, error) {
+	return string(g), nil
+}
+
+func TestV1IDCollision(t *testing.T) {
+	stor := initV1(t, "", constGenerator("qwe"), storage.DedupeGlobal)
+
+	shortURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/1", "", storage.ShortenOptions{})
+	require.NoError(t, err)
+	require.Equal(t, baseURL+"/qwe", shortURL)
+
+	_, err = stor.ShortenURL(ctx, "http://oknetcumk.biz/2", "", storage.ShortenOptions{})
+	require.ErrorIs(t, err, storage.ErrIDCollision)
+}
+
+func TestV1Expiration(t *testing.T) {
+	fileStoragePath := filepath.Join(t.TempDir(), "storage.json")
+	stor := initV1(t, fileStoragePath, idGen, storage.DedupeGlobal)
+
+	now := time.Now()
+	past := now.Add(-time.Minute)
+
+	liveURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/live", "", storage.ShortenOptions{TTL: 60})
+	require.NoError(t, err)
+	liveID := liveURL[len(baseURL)+1:]
+
+	expiredURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/expired", "", storage.ShortenOptions{ExpiresAt: &past})
+	require.NoError(t, err)
+	expiredID := expiredURL[len(baseURL)+1:]
+
+	_, err = stor.GetOriginalURL(ctx, liveID, "")
+	require.NoError(t, err)
+
+	_, err = stor.GetOriginalURL(ctx, expiredID, "")
+	require.ErrorIs(t, err, storage.ErrValueGone)
+
+	purged, err := stor.PurgeExpired(ctx, now)
+	require.NoError(t, err)
+	require.Equal(t, 1, purged)
+
+	_, err = stor.GetOriginalURL(ctx, expiredID, "")
+	require.ErrorIs(t, err, storage.ErrValueNotFound)
+
+	restored := initV1(t, fileStoragePath, idGen, storage.DedupeGlobal)
+
+	_, err = restored.GetOriginalURL(ctx, expiredID, "")
+	require.ErrorIs(t, err, storage.ErrValueNotFound)
+
+	purged, err = restored.PurgeExpired(ctx, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 1, purged)
+
+	_, err = restored.ShortenURL(ctx, "http://oknetcumk.biz/live", "", storage.ShortenOptions{})
+	require.NoError(t, err)
+}
+
+func initV1(t *testing.T, fileStoragePath string, idGen idgen.Generator, dedupe storage.DedupeScope) *storage.V1 {
+	stor, err := storage.InitV1(baseURL, fileStoragePath, idGen, dedupe)
+	require.NoError(t, err)
+
+	return stor
+}
+
+// initTestV2 creates V2 in a throwaway schema of the database from
+// TEST_DATABASE_DSN, the test is skipped when it is not set.
+func initTestV2(t testing.TB, dedupe storage.DedupeScope) *storage.V2 {
+	stor, err := storage.InitV2(baseURL, ctx, testV2DSN(t), idGen, dedupe)
+	require.NoError(t, err)
+
+	return stor
+}
+
+// testV2DSN returns the address of a new database schema dropped once the
+// test is finished.
+func testV2DSN(t testing.TB) string {
+	connString, ok := os.LookupEnv("TEST_DATABASE_DSN")
+	if !ok {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	schema := fmt.Sprintf("storage_test_%d_%d", os.Getpid(), time.Now().UnixNano())
+
+	admin, err := pgxpool.Connect(ctx, connString)
+	require.NoError(t, err)
+	t.Cleanup(admin.Close)
+
+	_, err = admin.Exec(ctx, "CREATE SCHEMA "+schema+";")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		admin.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE;")
+	})
+
+	dsn, err := url.Parse(connString)
+	require.NoError(t, err)
+
+	query := dsn.Query()
+	query.Set("search_path", schema)
+	dsn.RawQuery = query.Encode()
+
+	return dsn.String()
+}
+
+// forEachStorage runs fn against V1 and V2 with the dedupe scope, reopen
+// restores V1 from its file and returns V2 as is.
+func forEachStorage(t *testing.T, dedupe storage.DedupeScope, fn func(t *testing.T, stor storage.Interface, reopen func() storage.Interface)) {
+	t.Run("V1", func(t *testing.T) {
+		fileStoragePath := filepath.Join(t.TempDir(), "storage.json")
+
+		stor := initV1(t, fileStoragePath, idGen, dedupe)
+		fn(t, stor, func() storage.Interface {
+			require.NoError(t, stor.Close())
+
+			stor = initV1(t, fileStoragePath, idGen, dedupe)
+			return stor
+		})
+	})
+
+	t.Run("V2", func(t *testing.T) {
+		stor := initTestV2(t, dedupe)
+		fn(t, stor, func() storage.Interface {
+			return stor
+		})
+	})
+}
+
+func TestDedupeScope(t *testing.T) {
+	const originalURL = "http://oknetcumk.biz/1"
+
+	t.Run("global", func(t *testing.T) {
+		forEachStorage(t, storage.DedupeGlobal, func(t *testing.T, stor storage.Interface, _ func() storage.Interface) {
+			firstURL, err := stor.ShortenURL(ctx, originalURL, "user_a", storage.ShortenOptions{})
+			require.NoError(t, err)
+
+			secondURL, err := stor.ShortenURL(ctx, originalURL, "user_b", storage.ShortenOptions{})
+			require.ErrorIs(t, err, storage.ErrValueAlreadyShorted)
+			require.Equal(t, firstURL, secondURL)
+		})
+	})
+
+	t.Run("user", func(t *testing.T) {
+		forEachStorage(t, storage.DedupeUser, func(t *testing.T, stor storage.Interface, _ func() storage.Interface) {
+			aURL, err := stor.ShortenURL(ctx, originalURL, "user_a", storage.ShortenOptions{})
+			require.NoError(t, err)
+
+			bURL, err := stor.ShortenURL(ctx, originalURL, "user_b", storage.ShortenOptions{})
+			require.NoError(t, err)
+			require.NotEqual(t, aURL, bURL)
+
+			againURL, err := stor.ShortenURL(ctx, originalURL, "user_a", storage.ShortenOptions{})
+			require.ErrorIs(t, err, storage.ErrValueAlreadyShorted)
+			require.Equal(t, aURL, againURL)
+
+			aID, bID := aURL[len(baseURL)+1:], bURL[len(baseURL)+1:]
+			require.NoError(t, stor.DeleteKeys(ctx, []string{aID}, "user_a"))
+
+			_, err = stor.GetOriginalURL(ctx, aID, "user_a")
+			require.ErrorIs(t, err, storage.ErrValueGone)
+
+			bOriginalURL, err := stor.GetOriginalURL(ctx, bID, "user_b")
+			require.NoError(t, err)
+			require.Equal(t, originalURL, bOriginalURL)
+
+			_, err = stor.GetOriginalURL(ctx, aID, "user_b")
+			require.Error(t, err)
+		})
+	})
+
+	t.Run("none", func(t *testing.T) {
+		forEachStorage(t, storage.DedupeNone, func(t *testing.T, stor storage.Interface, _ func() storage.Interface) {
+			firstURL, err := stor.ShortenURL(ctx, originalURL, "user_a", storage.ShortenOptions{})
+			require.NoError(t, err)
+
+			secondURL, err := stor.ShortenURL(ctx, originalURL, "user_a", storage.ShortenOptions{})
+			require.NoError(t, err)
+			require.NotEqual(t, firstURL, secondURL)
+		})
+	})
+}
+
+func TestV1DedupeScopeRestore(t *testing.T) {
+	fileStoragePath := filepath.Join(t.TempDir(), "storage.json")
+
+	stor := initV1(t, fileStoragePath, idGen, storage.DedupeUser)
+
+	aURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/1", "user_a", storage.ShortenOptions{})
+	require.NoError(t, err)
+	bURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/1", "user_b", storage.ShortenOptions{})
+	require.NoError(t, err)
+
+	restored := initV1(t, fileStoragePath, idGen, storage.DedupeUser)
+
+	shortURL, err := restored.ShortenURL(ctx, "http://oknetcumk.biz/1", "user_a", storage.ShortenOptions{})
+	require.ErrorIs(t, err, storage.ErrValueAlreadyShorted)
+	require.Equal(t, aURL, shortURL)
+
+	shortURL, err = restored.ShortenURL(ctx, "http://oknetcumk.biz/1", "user_b", storage.ShortenOptions{})
+	require.ErrorIs(t, err, storage.ErrValueAlreadyShorted)
+	require.Equal(t, bURL, shortURL)
+}
+
+func TestAliasOfShortenedURL(t *testing.T) {
+	forEachStorage(t, storage.DedupeGlobal, func(t *testing.T, stor storage.Interface, reopen func() storage.Interface) {
+		firstURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/promo", "some_token", storage.ShortenOptions{})
+		require.NoError(t, err)
+
+		aliasURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/promo", "some_token", storage.ShortenOptions{Alias: "promo"})
+		require.NoError(t, err)
+		require.Equal(t, baseURL+"/promo", aliasURL)
+
+		originalURL, err := stor.GetOriginalURL(ctx, "promo", "")
+		require.NoError(t, err)
+		require.Equal(t, "http://oknetcumk.biz/promo", originalURL)
+
+		// The same alias of the same URL is the existing link.
+		aliasURL, err = stor.ShortenURL(ctx, "http://oknetcumk.biz/promo", "other_token", storage.ShortenOptions{Alias: "promo"})
+		require.ErrorIs(t, err, storage.ErrValueAlreadyShorted)
+		require.Equal(t, baseURL+"/promo", aliasURL)
+
+		originalURL, err = stor.GetOriginalURL(ctx, "promo", "other_token")
+		require.NoError(t, err)
+		require.Equal(t, "http://oknetcumk.biz/promo", originalURL)
+
+		_, err = stor.ShortenURL(ctx, "http://oknetcumk.biz/other", "other_token", storage.ShortenOptions{Alias: "promo"})
+		require.ErrorIs(t, err, storage.ErrAliasTaken)
+
+		// The alias is not the link the URL is deduplicated to.
+		shortURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/promo", "some_token", storage.ShortenOptions{})
+		require.ErrorIs(t, err, storage.ErrValueAlreadyShorted)
+		require.Equal(t, firstURL, shortURL)
+
+		stor = reopen()
+
+		for i := 0; i < 10; i++ {
+			shortURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/promo", "some_token", storage.ShortenOptions{})
+			require.ErrorIs(t, err, storage.ErrValueAlreadyShorted)
+			require.NotEqual(t, baseURL+"/promo", shortURL)
+		}
+	})
+}
+
+func TestV1Cancellation(t *testing.T) {
+	stor := initV1(t, "", idGen, storage.DedupeGlobal)
+
+	_, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/1", "some_token", storage.ShortenOptions{})
+	require.NoError(t, err)
+
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	_, err = stor.GetUserArchive(canceledCtx, "some_token", storage.ArchiveOptions{})
+	require.ErrorIs(t, err, context.Canceled)
+
+	items := []storage.MappingItem{{CorrelationID: "1", OriginalURL: "http://oknetcumk.biz/2"}}
+	err = stor.ForEach(canceledCtx, items, "some_token", func(correlationID, shortURL string, err error) error {
+		return nil
+	})
+	require.ErrorIs(t, err, context.Canceled)
+
+	archive, err := stor.GetUserArchive(ctx, "some_token", storage.ArchiveOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(archive.URLs))
+}
+
+func TestV2ForEach(t *testing.T) {
+	stor := initTestV2(t, storage.DedupeUser)
+
+	existingURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/1", "some_token", storage.ShortenOptions{})
+	require.NoError(t, err)
+
+	items := []storage.MappingItem{
+		{CorrelationID: "existing", OriginalURL: "http://oknetcumk.biz/1"},
+		{CorrelationID: "new", OriginalURL: "http://oknetcumk.biz/2"},
+		{CorrelationID: "repeated", OriginalURL: "http://oknetcumk.biz/2"},
+		{CorrelationID: "alias", OriginalURL: "http://oknetcumk.biz/3", ShortenOptions: storage.ShortenOptions{Alias: "three"}},
+		{CorrelationID: "taken", OriginalURL: "http://oknetcumk.biz/4", ShortenOptions: storage.ShortenOptions{Alias: "three"}},
+	}
+
+	shortURLs := make(map[string]string)
+	errs := make(map[string]error)
+	err = stor.ForEach(ctx, items, "some_token", func(correlationID, shortURL string, err error) error {
+		shortURLs[correlationID], errs[correlationID] = shortURL, err
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.ErrorIs(t, errs["existing"], storage.ErrValueAlreadyShorted)
+	require.Equal(t, existingURL, shortURLs["existing"])
+
+	require.NoError(t, errs["new"])
+	require.NotEqual(t, existingURL, shortURLs["new"])
+
+	require.ErrorIs(t, errs["repeated"], storage.ErrValueAlreadyShorted)
+	require.Equal(t, shortURLs["new"], shortURLs["repeated"])
+
+	require.NoError(t, errs["alias"])
+	require.Equal(t, baseURL+"/three", shortURLs["alias"])
+
+	require.ErrorIs(t, errs["taken"], storage.ErrAliasTaken)
+
+	archive, err := stor.GetUserArchive(ctx, "some_token", storage.ArchiveOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(archive.URLs))
+}
+
+// BenchmarkV2ForEach compares the batched ForEach with shortening the items
+// one by one.
+func BenchmarkV2ForEach(b *testing.B) {
+	const batchSize = 1000
+
+	stor := initTestV2(b, storage.DedupeUser)
+
+	// Every round shortens new URLs, so nothing is deduplicated.
+	round := 0
+	items := func() []storage.MappingItem {
+		round++
+
+		res := make([]storage.MappingItem, batchSize)
+		for i := range res {
+			res[i] = storage.MappingItem{
+				CorrelationID: fmt.Sprint(i),
+				OriginalURL:   fmt.Sprintf("http://oknetcumk.biz/%d/%d", round, i),
+			}
+		}
+
+		return res
+	}
+
+	b.Run("loop", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, item := range items() {
+				_, err := stor.ShortenURL(ctx, item.OriginalURL, "loop_user", item.ShortenOptions)
+				require.NoError(b, err)
+			}
+		}
+	})
+
+	b.Run("batch", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			err := stor.ForEach(ctx, items(), "batch_user", func(correlationID, shortURL string, err error) error {
+				return err
+			})
+			require.NoError(b, err)
+		}
+	})
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	forEachStorage(t, storage.DedupeGlobal, func(t *testing.T, stor storage.Interface, _ func() storage.Interface) {
+		sharedURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/shared", "user_a", storage.ShortenOptions{})
+		require.NoError(t, err)
+		_, err = stor.ShortenURL(ctx, "http://oknetcumk.biz/shared", "user_b", storage.ShortenOptions{})
+		require.ErrorIs(t, err, storage.ErrValueAlreadyShorted)
+
+		ownURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/own", "user_a", storage.ShortenOptions{})
+		require.NoError(t, err)
+
+		sharedID, ownID := sharedURL[len(baseURL)+1:], ownURL[len(baseURL)+1:]
+		require.NoError(t, stor.DeleteKeys(ctx, []string{sharedID, ownID}, "user_a"))
+
+		archive, err := stor.GetUserArchive(ctx, "user_a", storage.ArchiveOptions{})
+		require.NoError(t, err)
+		require.Equal(t, 0, len(archive.URLs))
+
+		archive, err = stor.GetUserArchive(ctx, "user_a", storage.ArchiveOptions{IncludeDeleted: true})
+		require.NoError(t, err)
+		require.Equal(t, 2, len(archive.URLs))
+		for _, item := range archive.URLs {
+			require.NotNil(t, item.DeletedAt)
+		}
+
+		restored, err := stor.RestoreKeys(ctx, []string{ownID, "unknown"}, "user_a")
+		require.NoError(t, err)
+		require.Equal(t, []string{ownID}, restored)
+
+		_, err = stor.GetOriginalURL(ctx, ownID, "user_a")
+		require.NoError(t, err)
+
+		require.NoError(t, stor.DeleteKeys(ctx, []string{ownID}, "user_a"))
+
+		purged, err := stor.PurgeDeleted(ctx, time.Now().Add(-time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, 0, purged)
+
+		purged, err = stor.PurgeDeleted(ctx, time.Now().Add(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, 1, purged)
+
+		_, err = stor.GetOriginalURL(ctx, ownID, "")
+		require.ErrorIs(t, err, storage.ErrValueNotFound)
+
+		_, err = stor.GetOriginalURL(ctx, sharedID, "user_b")
+		require.NoError(t, err)
+
+		restored, err = stor.RestoreKeys(ctx, []string{ownID, sharedID}, "user_a")
+		require.NoError(t, err)
+		require.Equal(t, 0, len(restored))
+	})
+}
+
+func TestDeleteForeignKeys(t *testing.T) {
+	forEachStorage(t, storage.DedupeGlobal, func(t *testing.T, stor storage.Interface, _ func() storage.Interface) {
+		victimURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/victim", "victim", storage.ShortenOptions{})
+		require.NoError(t, err)
+		victimID := victimURL[len(baseURL)+1:]
+
+		_, err = stor.ShortenURL(ctx, "http://oknetcumk.biz/attacker", "attacker", storage.ShortenOptions{})
+		require.NoError(t, err)
+
+		require.NoError(t, stor.DeleteKeys(ctx, []string{victimID}, "attacker"))
+
+		restored, err := stor.RestoreKeys(ctx, []string{victimID}, "attacker")
+		require.NoError(t, err)
+		require.Empty(t, restored)
+
+		archive, err := stor.GetUserArchive(ctx, "attacker", storage.ArchiveOptions{IncludeDeleted: true})
+		require.NoError(t, err)
+		require.Equal(t, 1, len(archive.URLs))
+		require.Equal(t, "http://oknetcumk.biz/attacker", archive.URLs[0].OriginalURL)
+
+		_, err = stor.GetLinkStats(ctx, victimID, "attacker")
+		require.ErrorIs(t, err, storage.ErrValueNotFound)
+
+		archive, err = stor.GetUserArchive(ctx, "victim", storage.ArchiveOptions{})
+		require.NoError(t, err)
+		require.Equal(t, 1, len(archive.URLs))
+	})
+}
+
+func TestV1DeletedPersistence(t *testing.T) {
+	fileStoragePath := filepath.Join(t.TempDir(), "storage.json")
+
+	stor := initV1(t, fileStoragePath, idGen, storage.DedupeGlobal)
+
+	shortURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/1", "some_token", storage.ShortenOptions{})
+	require.NoError(t, err)
+	require.NoError(t, stor.DeleteKeys(ctx, []string{shortURL[len(baseURL)+1:]}, "some_token"))
+
+	restored := initV1(t, fileStoragePath, idGen, storage.DedupeGlobal)
+
+	purged, err := restored.PurgeDeleted(ctx, time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 0, purged)
+
+	purged, err = restored.PurgeDeleted(ctx, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 1, purged)
+}
+
+func TestUserArchivePages(t *testing.T) {
+	forEachStorage(t, storage.DedupeGlobal, func(t *testing.T, stor storage.Interface, _ func() storage.Interface) {
+		originalURLs := []string{
+			"http://oknetcumk.biz/1",
+			"http://www.oknetcumk.biz/2",
+			"http://OKNETCUMK.BIZ/Path",
+			"http://notoknetcumk.biz/4",
+			"https://user@example.com:8080/5",
+		}
+
+		shortURLIds := make(map[string]string)
+		for i, originalURL := range originalURLs {
+			shortURL, err := stor.ShortenURL(ctx, originalURL, "some_token", storage.ShortenOptions{})
+			require.NoError(t, err)
+
+			shortURLIds[originalURL] = shortURL[len(baseURL)+1:]
+
+			clicks := make([]storage.Click, i)
+			for j := range clicks {
+				clicks[j] = storage.Click{ShortURLId: shortURLIds[originalURL], Time: time.Now()}
+			}
+			require.NoError(t, stor.RecordClicks(ctx, clicks))
+		}
+
+		collect := func(opts storage.ArchiveOptions) []string {
+			res := make([]string, 0)
+			for {
+				page, err := stor.GetUserArchive(ctx, "some_token", opts)
+				require.NoError(t, err)
+				require.LessOrEqual(t, len(page.URLs), opts.Limit)
+
+				for _, item := range page.URLs {
+					res = append(res, item.OriginalURL)
+				}
+
+				if page.NextCursor == "" {
+					return res
+				}
+
+				opts.Cursor = page.NextCursor
+			}
+		}
+
+		all, err := stor.GetUserArchive(ctx, "some_token", storage.ArchiveOptions{})
+		require.NoError(t, err)
+		require.Equal(t, len(originalURLs), len(all.URLs))
+		require.Empty(t, all.NextCursor)
+
+		expected := make([]string, 0)
+		for _, item := range all.URLs {
+			expected = append(expected, item.OriginalURL)
+		}
+		require.Equal(t, expected, collect(storage.ArchiveOptions{Limit: 2}))
+
+		byClicks := collect(storage.ArchiveOptions{Sort: storage.ArchiveSortClicks, Limit: 2})
+		require.Equal(t, []string{originalURLs[4], originalURLs[3], originalURLs[2], originalURLs[1], originalURLs[0]}, byClicks)
+
+		byClicks = collect(storage.ArchiveOptions{Sort: storage.ArchiveSortClicks, Ascending: true, Limit: 3})
+		require.Equal(t, originalURLs, byClicks)
+
+		filtered := collect(storage.ArchiveOptions{Sort: storage.ArchiveSortClicks, Ascending: true, Domain: "oknetcumk.biz", Limit: 1})
+		require.Equal(t, originalURLs[:3], filtered)
+
+		filtered = collect(storage.ArchiveOptions{Sort: storage.ArchiveSortClicks, Ascending: true, Query: "path", Limit: 1})
+		require.Equal(t, []string{originalURLs[2]}, filtered)
+
+		filtered = collect(storage.ArchiveOptions{Domain: "example.com", Limit: 10})
+		require.Equal(t, []string{originalURLs[4]}, filtered)
+
+		page, err := stor.GetUserArchive(ctx, "some_token", storage.ArchiveOptions{Sort: storage.ArchiveSortClicks, Limit: 1})
+		require.NoError(t, err)
+		require.Equal(t, 5-1, page.URLs[0].Clicks)
+
+		_, err = stor.GetUserArchive(ctx, "some_token", storage.ArchiveOptions{Limit: 1, Cursor: page.NextCursor})
+		require.ErrorIs(t, err, storage.ErrInvalidCursor)
+
+		_, err = stor.GetUserArchive(ctx, "some_token", storage.ArchiveOptions{Limit: 1, Cursor: "!"})
+		require.ErrorIs(t, err, storage.ErrInvalidCursor)
+	})
+}
+
+func TestLinkMetadata(t *testing.T) {
+	forEachStorage(t, storage.DedupeGlobal, func(t *testing.T, stor storage.Interface, reopen func() storage.Interface) {
+		before := time.Now().Add(-time.Second)
+
+		opts := storage.ShortenOptions{Title: "Spring sale", Description: "Landing page"}
+		_, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/1", "user_a", opts)
+		require.NoError(t, err)
+
+		items := []storage.MappingItem{{
+			CorrelationID:  "1",
+			OriginalURL:    "http://oknetcumk.biz/2",
+			ShortenOptions: storage.ShortenOptions{Title: "Autumn sale"},
+		}}
+		err = stor.ForEach(ctx, items, "user_a", func(correlationID, shortURL string, err error) error {
+			return err
+		})
+		require.NoError(t, err)
+
+		opts = storage.ShortenOptions{Title: "Another title"}
+		_, err = stor.ShortenURL(ctx, "http://oknetcumk.biz/1", "user_b", opts)
+		require.ErrorIs(t, err, storage.ErrValueAlreadyShorted)
+
+		stor = reopen()
+
+		archive, err := stor.GetUserArchive(ctx, "user_b", storage.ArchiveOptions{})
+		require.NoError(t, err)
+		require.Equal(t, 1, len(archive.URLs))
+
+		item := archive.URLs[0]
+		require.Equal(t, "Spring sale", item.Title)
+		require.Equal(t, "Landing page", item.Description)
+		require.Equal(t, "user_a", item.CreatedBy)
+		require.True(t, item.CreatedAt.After(before))
+		require.False(t, item.UpdatedAt.Before(item.CreatedAt))
+
+		archive, err = stor.GetUserArchive(ctx, "user_a", storage.ArchiveOptions{Query: "/2"})
+		require.NoError(t, err)
+		require.Equal(t, 1, len(archive.URLs))
+		require.Equal(t, "Autumn sale", archive.URLs[0].Title)
+
+		// Every change of the link moves the update moment.
+		id := strings.TrimPrefix(item.ShortURL, baseURL+"/")
+		mutations := map[string]func() error{
+			"tag": func() error {
+				_, err := stor.AddTags(ctx, id, "user_b", []string{"sale"})
+				return err
+			},
+			"untag": func() error {
+				_, err := stor.RemoveTags(ctx, id, "user_b", []string{"sale"})
+				return err
+			},
+			"move": func() error {
+				return stor.MoveToFolder(ctx, id, "user_b", "promo")
+			},
+			"delete": func() error {
+				return stor.DeleteKeys(ctx, []string{id}, "user_b")
+			},
+			"restore": func() error {
+				_, err := stor.RestoreKeys(ctx, []string{id}, "user_b")
+				return err
+			},
+		}
+
+		updatedAt := item.UpdatedAt
+		for _, mutation := range []string{"tag", "untag", "move", "delete", "restore"} {
+			require.NoError(t, mutations[mutation](), mutation)
+
+			stor = reopen()
+
+			archive, err = stor.GetUserArchive(ctx, "user_b", storage.ArchiveOptions{IncludeDeleted: true})
+			require.NoError(t, err)
+			require.Equal(t, 1, len(archive.URLs))
+			require.True(t, archive.URLs[0].UpdatedAt.After(updatedAt), mutation)
+
+			updatedAt = archive.URLs[0].UpdatedAt
+		}
+	})
+}
+
+func TestLinkLabels(t *testing.T) {
+	forEachStorage(t, storage.DedupeGlobal, func(t *testing.T, stor storage.Interface, reopen func() storage.Interface) {
+		shortURLIds := make([]string, 0)
+		for i := 0; i < 3; i++ {
+			shortURL, err := stor.ShortenURL(ctx, fmt.Sprintf("http://oknetcumk.biz/%d", i), "user_a", storage.ShortenOptions{})
+			require.NoError(t, err)
+
+			shortURLIds = append(shortURLIds, shortURL[len(baseURL)+1:])
+		}
+
+		tags, err := stor.AddTags(ctx, shortURLIds[0], "user_a", []string{"sale", "spring"})
+		require.NoError(t, err)
+		require.Equal(t, []string{"sale", "spring"}, tags)
+
+		tags, err = stor.AddTags(ctx, shortURLIds[1], "user_a", []string{"sale"})
+		require.NoError(t, err)
+		require.Equal(t, []string{"sale"}, tags)
+
+		tags, err = stor.RemoveTags(ctx, shortURLIds[0], "user_a", []string{"spring", "unknown"})
+		require.NoError(t, err)
+		require.Equal(t, []string{"sale"}, tags)
+
+		require.NoError(t, stor.MoveToFolder(ctx, shortURLIds[1], "user_a", "campaigns"))
+		require.NoError(t, stor.MoveToFolder(ctx, shortURLIds[2], "user_a", "campaigns"))
+
+		_, err = stor.AddTags(ctx, shortURLIds[0], "user_b", []string{"sale"})
+		require.ErrorIs(t, err, storage.ErrValueNotFound)
+		require.ErrorIs(t, stor.MoveToFolder(ctx, "unknown", "user_a", "campaigns"), storage.ErrValueNotFound)
+
+		stor = reopen()
+
+		archiveIds := func(opts storage.ArchiveOptions) []string {
+			opts.Sort, opts.Ascending = storage.ArchiveSortCreated, true
+
+			archive, err := stor.GetUserArchive(ctx, "user_a", opts)
+			require.NoError(t, err)
+
+			res := make([]string, 0)
+			for _, item := range archive.URLs {
+				res = append(res, item.ShortURL[len(baseURL)+1:])
+			}
+
+			return res
+		}
+
+		require.ElementsMatch(t, shortURLIds[:2], archiveIds(storage.ArchiveOptions{Tag: "sale"}))
+		require.ElementsMatch(t, shortURLIds[1:], archiveIds(storage.ArchiveOptions{Folder: "campaigns"}))
+		require.Equal(t, []string{shortURLIds[1]}, archiveIds(storage.ArchiveOptions{Tag: "sale", Folder: "campaigns"}))
+
+		archive, err := stor.GetUserArchive(ctx, "user_a", storage.ArchiveOptions{Tag: "sale", Folder: "campaigns"})
+		require.NoError(t, err)
+		require.Equal(t, []string{"sale"}, archive.URLs[0].Tags)
+		require.Equal(t, "campaigns", archive.URLs[0].Folder)
+
+		require.NoError(t, stor.DeleteKeys(ctx, shortURLIds[:1], "user_a"))
+		purged, err := stor.PurgeDeleted(ctx, time.Now().Add(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, 1, purged)
+
+		require.Equal(t, []string{shortURLIds[1]}, archiveIds(storage.ArchiveOptions{Tag: "sale"}))
+	})
+}
+
+func TestV1DedupeCanonicalURL(t *testing.T) {
+	fileStoragePath := filepath.Join(t.TempDir(), "storage.json")
+
+	// A link stored before the URLs were normalized.
+	legacy := `{"1":"HTTP://OKNETCUMK.biz:80"}`
+	require.NoError(t, os.WriteFile(fileStoragePath, []byte(legacy), 0644))
+
+	stor := initV1(t, fileStoragePath, idGen, storage.DedupeGlobal)
+
+	shortURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/", "", storage.ShortenOptions{})
+	require.ErrorIs(t, err, storage.ErrValueAlreadyShorted)
+	require.Equal(t, baseURL+"/1", shortURL)
+}
+
+func TestV2DedupeCanonicalURL(t *testing.T) {
+	dsn := testV2DSN(t)
+
+	_, err := storage.InitV2(baseURL, ctx, dsn, idGen, storage.DedupeGlobal)
+	require.NoError(t, err)
+
+	conn, err := pgxpool.Connect(ctx, dsn)
+	require.NoError(t, err)
+	t.Cleanup(conn.Close)
+
+	// A link stored before the URLs were normalized, the key of it was made
+	// of the URL as it is.
+	_, err = conn.Exec(ctx, "INSERT INTO shortensArchive (shortenURLId, originalURL, dedupeKey) VALUES ('1', $1, $1);", "HTTP://OKNETCUMK.biz:80")
+	require.NoError(t, err)
+
+	stor, err := storage.InitV2(baseURL, ctx, dsn, idGen, storage.DedupeGlobal)
+	require.NoError(t, err)
+
+	shortURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/", "", storage.ShortenOptions{})
+	require.ErrorIs(t, err, storage.ErrValueAlreadyShorted)
+	require.Equal(t, baseURL+"/1", shortURL)
+}
+
+func TestLinkInfo(t *testing.T) {
+	forEachStorage(t, storage.DedupeGlobal, func(t *testing.T, stor storage.Interface, reopen func() storage.Interface) {
+		opts := storage.ShortenOptions{Title: "Spring sale", Description: "Landing page", Preview: true}
+		previewURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/preview", "user_a", opts)
+		require.NoError(t, err)
+
+		items := []storage.MappingItem{{
+			CorrelationID:  "1",
+			OriginalURL:    "http://oknetcumk.biz/batch",
+			ShortenOptions: storage.ShortenOptions{Preview: true},
+		}}
+		batchURL := ""
+		err = stor.ForEach(ctx, items, "user_a", func(correlationID, shortURL string, err error) error {
+			batchURL = shortURL
+			return err
+		})
+		require.NoError(t, err)
+
+		plainURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/plain", "user_a", storage.ShortenOptions{})
+		require.NoError(t, err)
+
+		expiresAt := time.Now().Add(-time.Minute)
+		expiredURL, err := stor.ShortenURL(ctx, "http://oknetcumk.biz/expired", "", storage.ShortenOptions{ExpiresAt: &expiresAt})
+		require.NoError(t, err)
+
+		stor = reopen()
+
+		info, err := stor.GetLinkInfo(ctx, strings.TrimPrefix(previewURL, baseURL+"/"), "")
+		require.NoError(t, err)
+		require.Equal(t, previewURL, info.ShortURL)
+		require.Equal(t, "http://oknetcumk.biz/preview", info.OriginalURL)
+		require.Equal(t, "Spring sale", info.Title)
+		require.Equal(t, "Landing page", info.Description)
+		require.False(t, info.CreatedAt.IsZero())
+		require.True(t, info.Preview)
+
+		info, err = stor.GetLinkInfo(ctx, strings.TrimPrefix(batchURL, baseURL+"/"), "")
+		require.NoError(t, err)
+		require.True(t, info.Preview)
+
+		info, err = stor.GetLinkInfo(ctx, strings.TrimPrefix(plainURL, baseURL+"/"), "")
+		require.NoError(t, err)
+		require.False(t, info.Preview)
+
+		_, err = stor.GetLinkInfo(ctx, strings.TrimPrefix(expiredURL, baseURL+"/"), "")
+		require.ErrorIs(t, err, storage.ErrValueGone)
+
+		_, err = stor.GetLinkInfo(ctx, "missing", "")
+		require.ErrorIs(t, err, storage.ErrValueNotFound)
+
+		info, err = stor.GetLinkInfo(ctx, strings.TrimPrefix(plainURL, baseURL+"/"), "user_a")
+		require.NoError(t, err)
+		require.Equal(t, "http://oknetcumk.biz/plain", info.OriginalURL)
+
+		require.NoError(t, stor.DeleteKeys(ctx, []string{strings.TrimPrefix(plainURL, baseURL+"/")}, "user_a"))
+		_, err = stor.GetLinkInfo(ctx, strings.TrimPrefix(plainURL, baseURL+"/"), "user_a")
+		require.ErrorIs(t, err, storage.ErrValueGone)
+
+		archive, err := stor.GetUserArchive(ctx, "user_a", storage.ArchiveOptions{Query: "/preview"})
+		require.NoError(t, err)
+		require.Equal(t, 1, len(archive.URLs))
+		require.True(t, archive.URLs[0].Preview)
+	})
+}
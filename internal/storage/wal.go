@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type walOp string
+
+const (
+	walOpCreate walOp = "create"
+	walOpOwn    walOp = "own"
+	walOpDelete walOp = "delete"
+	walOpDisown walOp = "disown"
+	walOpPurge  walOp = "purge"
+	walOpClick  walOp = "click"
+	walOpTag    walOp = "tag"
+	walOpUntag  walOp = "untag"
+	walOpMove   walOp = "move"
+
+	walOpKeyCreate walOp = "key_create"
+	walOpKeyRevoke walOp = "key_revoke"
+)
+
+// Amount of records appended to the log after which V1 takes a new snapshot
+// and compacts the log.
+const walSnapshotThreshold = 10000
+
+type walRecord struct {
+	Op          walOp      `json:"op"`
+	LSN         uint64     `json:"lsn,omitempty"`
+	ShortURLId  string     `json:"id"`
+	OriginalURL string     `json:"url,omitempty"`
+	UserUUID    string     `json:"user,omitempty"`
+	Seq         uint64     `json:"seq,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	ClickedAt   *time.Time `json:"clicked_at,omitempty"`
+	Referrer    string     `json:"referrer,omitempty"`
+	UserAgent   string     `json:"user_agent,omitempty"`
+	IPHash      string     `json:"ip_hash,omitempty"`
+	KeyID       string     `json:"key_id,omitempty"`
+	KeyName     string     `json:"key_name,omitempty"`
+	KeyHash     string     `json:"key_hash,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+	Title       string     `json:"title,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Preview     bool       `json:"preview,omitempty"`
+	Alias       bool       `json:"alias,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Folder      string     `json:"folder,omitempty"`
+}
+
+// wal is an append-only log of V1 mutations stored as one JSON record per line.
+// Every record is fsynced before append returns. A nil *wal is valid and
+// persists nothing.
+//
+// The records are numbered by LSN growing across the compactions, so the
+// snapshot knows which of them it already has.
+type wal struct {
+	path string
+	file *os.File
+	mux  sync.Mutex
+
+	records int
+	lsn     uint64
+}
+
+func openWAL(path string) (*wal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &wal{path: path, file: file}, nil
+}
+
+// replay calls apply for every complete record of the log after the applied
+// LSN, the earlier ones are left by a compaction interrupted before the log was
+// truncated. The records without LSN are written before the numbering and so
+// are in any snapshot with a set applied LSN. A torn or corrupted tail (e.g.
+// after a crash in the middle of a write) is cut off.
+func (w *wal) replay(applied uint64, apply func(walRecord)) error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	w.lsn = applied
+
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(w.file)
+	offset := int64(0)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		record := walRecord{}
+		if json.Unmarshal(line, &record) != nil {
+			break
+		}
+
+		if applied == 0 || record.LSN > applied {
+			apply(record)
+
+			if record.LSN == 0 {
+				w.lsn++
+			} else if record.LSN > w.lsn {
+				w.lsn = record.LSN
+			}
+		}
+
+		offset += int64(len(line))
+		w.records++
+	}
+
+	if err := w.file.Truncate(offset); err != nil {
+		return err
+	}
+
+	_, err := w.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (w *wal) append(records ...walRecord) error {
+	if w == nil {
+		return nil
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	buf := make([]byte, 0, 128*len(records))
+	for i, record := range records {
+		record.LSN = w.lsn + uint64(i) + 1
+
+		recordBytes, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		buf = append(append(buf, recordBytes...), '\n')
+	}
+
+	if _, err := w.file.Write(buf); err != nil {
+		return err
+	}
+
+	w.records += len(records)
+	w.lsn += uint64(len(records))
+
+	return w.file.Sync()
+}
+
+// lastLSN returns the LSN of the last appended or replayed record.
+func (w *wal) lastLSN() uint64 {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	return w.lsn
+}
+
+func (w *wal) needsCompaction() bool {
+	if w == nil {
+		return false
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	return w.records >= walSnapshotThreshold
+}
+
+// rewrite atomically replaces the log with the given records.
+func (w *wal) rewrite(records []walRecord) error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	err := writeFileSync(w.path, func(writer io.Writer) error {
+		encoder := json.NewEncoder(writer)
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w.file.Close()
+
+	w.file, err = os.OpenFile(w.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	w.records = len(records)
+
+	return nil
+}
+
+func (w *wal) close() error {
+	if w == nil {
+		return nil
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	return w.file.Close()
+}
+
+// writeFileSync writes a file through a temporary one, so readers only ever
+// see either the old or the new content.
+func writeFileSync(path string, write func(io.Writer) error) error {
+	tmpPath := path + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	if err = write(writer); err == nil {
+		if err = writer.Flush(); err == nil {
+			err = file.Sync()
+		}
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// copyFileSync copies the file through writeFileSync.
+func copyFileSync(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+
+	return writeFileSync(dstPath, func(writer io.Writer) error {
+		_, err := io.Copy(writer, src)
+		return err
+	})
+}
@@ -0,0 +1,118 @@
+package urlpolicy
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+)
+
+var ErrEmptyURL = errors.New("url is empty")
+var ErrMalformedURL = errors.New("url is malformed")
+var ErrUnsupportedScheme = errors.New("only http and https urls can be shortened")
+var ErrMissingHost = errors.New("url has no host")
+var ErrBadHost = errors.New("url host is invalid")
+var ErrBadPort = errors.New("url port is invalid")
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Normalize checks the URL can be shortened and returns its canonical form:
+// the scheme and the host are lowercased, the international domain names are
+// converted to punycode, the default port, the empty query and the empty
+// fragment are dropped and the empty path becomes "/". The fragment itself is
+// kept as the pages may rely on it.
+func Normalize(rawURL string) (string, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if rawURL == "" {
+		return "", ErrEmptyURL
+	}
+
+	if strings.IndexFunc(rawURL, unicode.IsSpace) != -1 {
+		return "", ErrMalformedURL
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", ErrMalformedURL
+	}
+
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	defaultPort, ok := defaultPorts[parsed.Scheme]
+	if !ok {
+		return "", ErrUnsupportedScheme
+	}
+
+	if parsed.Opaque != "" {
+		return "", ErrMalformedURL
+	}
+
+	host, err := normalizeHost(parsed.Hostname())
+	if err != nil {
+		return "", err
+	}
+
+	port := parsed.Port()
+	if port != "" {
+		if number, err := strconv.Atoi(port); err != nil || number < 1 || number > 65535 {
+			return "", ErrBadPort
+		}
+	}
+
+	if port == defaultPort {
+		port = ""
+	}
+
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	if port != "" {
+		host += ":" + port
+	}
+
+	parsed.Host = host
+	parsed.ForceQuery = false
+
+	if parsed.Path == "" {
+		parsed.Path, parsed.RawPath = "/", ""
+	}
+
+	return parsed.String(), nil
+}
+
+// normalizeHost lowercases the host converting the international domain name
+// to punycode, the IP addresses are kept as they are.
+func normalizeHost(host string) (string, error) {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" {
+		return "", ErrMissingHost
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return strings.ToLower(host), nil
+	}
+
+	host, err := idna.Lookup.ToASCII(strings.ToLower(host))
+	if err != nil {
+		return "", ErrBadHost
+	}
+
+	return host, nil
+}
+
+// Key returns the canonical form of the URL to deduplicate the links by, the
+// URL itself if it can not be normalized.
+func Key(rawURL string) string {
+	if normalized, err := Normalize(rawURL); err == nil {
+		return normalized
+	}
+
+	return rawURL
+}